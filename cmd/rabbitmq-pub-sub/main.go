@@ -33,8 +33,8 @@ func main() {
 		return
 	}
 
-	// Connecting to rabbit mq
-	if err := messagebrokers.RabbitMQConnect(); err != nil {
+	// Connecting to the configured message broker
+	if err := messagebrokers.Connect(); err != nil {
 		log.Fatal(err)
 		return
 	}
@@ -46,18 +46,20 @@ func main() {
 	wg.Add(n)
 	// Firing up 10 consumers
 	for i := 0; i < n; i++ {
-		go messagebrokers.RabbitMQ().ReceiveMessages(wg)
+		go messagebrokers.ReceiveMessages(wg, messagebrokers.Broker())
 		time.Sleep(time.Millisecond * 200)
 	}
 
 	message := map[string]any{"Rabbit": "Kafka"}
-	messagebrokers.RabbitMQ().SendMessages(message)
+	messagebrokers.SendMessages(messagebrokers.Broker(), message)
 
 	<-global.CancellationContext().Done()
 	wg.Wait()
 
-	messagebrokers.RabbitMQ().DeleteAllQueues()
-	messagebrokers.RabbitMQ().Shutdown()
+	if r := messagebrokers.RabbitMQ(); r != nil {
+		r.DeleteAllQueues()
+	}
+	messagebrokers.Broker().Shutdown()
 
 	loggers.Zap.Sync()
 }
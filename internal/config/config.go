@@ -23,12 +23,136 @@ type Configuration struct {
 		} `koanf:"postgres"`
 	} `koanf:"database"`
 
+	// Broker selects the message broker backend: rabbitmq (default), memory,
+	// postgres or kafka
+	Broker struct {
+		Backend string `koanf:"backend"`
+
+		// Postgres configures the LISTEN/NOTIFY backend. Consumers catch up
+		// from the message table every PollInterval seconds, BatchSize rows
+		// at a time, and messages are kept for Retention seconds.
+		Postgres struct {
+			PollInterval int `koanf:"poll_interval"`
+			BatchSize    int `koanf:"batch_size"`
+			Retention    int `koanf:"retention"`
+		} `koanf:"postgres"`
+
+		// Kafka configures the Kafka backend. Topics are created with
+		// Partitions partitions and ReplicationFactor replicas, or the
+		// cluster defaults when zero.
+		Kafka struct {
+			Brokers           []string `koanf:"brokers"`
+			ClientId          string   `koanf:"client_id"`
+			Partitions        int      `koanf:"partitions"`
+			ReplicationFactor int      `koanf:"replication_factor"`
+		} `koanf:"kafka"`
+	} `koanf:"broker"`
+
 	RabbitMQ struct {
+		// URL is a full amqp:// or amqps:// URI. When set it takes precedence
+		// over Host, Port, User, Password and Vhost.
+		URL      string `koanf:"url"`
 		Host     string `koanf:"host"`
 		Port     int    `koanf:"port"`
 		User     string `koanf:"user"`
 		Password string `koanf:"password"`
-		Exchange string `koanf:"exchange"`
+		Vhost    string `koanf:"vhost"`
+		// Endpoints lists the cluster nodes as host:port. When set they
+		// replace Host and Port, and the host of URL.
+		Endpoints []string `koanf:"endpoints"`
+		// EndpointStrategy is the order nodes are dialled in on connect and
+		// reconnect: ordered (default), random or round_robin
+		EndpointStrategy string `koanf:"endpoint_strategy"`
+		Exchange         string `koanf:"exchange"`
+		// Auth is the SASL mechanism, plain by default or external to
+		// authenticate with the TLS client certificate
+		Auth string `koanf:"auth"`
+		// ConnectionName is shown in the management UI and defaults to AppId
+		ConnectionName string `koanf:"connection_name"`
+		// Heartbeat is the heartbeat interval in seconds, 10 by default
+		Heartbeat int `koanf:"heartbeat"`
+		// ChannelMax and FrameSize are negotiated with the broker; zero
+		// accepts the broker's limits
+		ChannelMax int `koanf:"channel_max"`
+		FrameSize  int `koanf:"frame_size"`
+
+		// TLS is used for amqps connections. The system roots are trusted
+		// unless CAFile names a PEM bundle, and CertFile and KeyFile hold the
+		// client certificate for mutual TLS.
+		TLS struct {
+			Enabled            bool   `koanf:"enabled"`
+			CAFile             string `koanf:"ca_file"`
+			CertFile           string `koanf:"cert_file"`
+			KeyFile            string `koanf:"key_file"`
+			ServerName         string `koanf:"server_name"`
+			InsecureSkipVerify bool   `koanf:"insecure_skip_verify"`
+		} `koanf:"tls"`
+
+		// AppId is stamped on every published message
+		AppId string `koanf:"app_id"`
+		// ConfirmTimeout is the number of seconds to wait for a publisher confirm
+		ConfirmTimeout int `koanf:"confirm_timeout"`
+		// RPCTimeout is the number of seconds an RPC call waits for its reply
+		// when the caller's context has no deadline
+		RPCTimeout int `koanf:"rpc_timeout"`
+		// Mandatory publishes messages as mandatory by default, so unroutable
+		// ones are returned instead of silently dropped
+		Mandatory bool `koanf:"mandatory"`
+		// PublishChannels bounds the pool of confirm-mode channels shared by
+		// concurrent publishers, 8 by default
+		PublishChannels int `koanf:"publish_channels"`
+
+		Consumer struct {
+			AutoAck       bool `koanf:"auto_ack"`
+			PrefetchCount int  `koanf:"prefetch_count"`
+		} `koanf:"consumer"`
+
+		// Retry configures delayed redelivery through TTL queues. Tiers are in
+		// seconds and are derived from the backoff section when left empty.
+		Retry struct {
+			Tiers       []int `koanf:"tiers"`
+			MaxAttempts int   `koanf:"max_attempts"`
+		} `koanf:"retry"`
+
+		// Dedup skips messages already processed by the same consumer within
+		// Window seconds. Rows older than that are pruned every PruneInterval seconds.
+		Dedup struct {
+			Window        int `koanf:"window"`
+			PruneInterval int `koanf:"prune_interval"`
+		} `koanf:"dedup"`
+
+		// Outbox relays messages stored in Postgres every PollInterval seconds,
+		// or earlier when notified, at most BatchSize at a time. Sent rows are
+		// kept for Retention seconds and pruned every PruneInterval seconds.
+		Outbox struct {
+			PollInterval  int `koanf:"poll_interval"`
+			BatchSize     int `koanf:"batch_size"`
+			Retention     int `koanf:"retention"`
+			PruneInterval int `koanf:"prune_interval"`
+		} `koanf:"outbox"`
+
+		// Publisher configures the in-process fan-out of received messages.
+		// The last ReplaySize messages no older than ReplayWindow seconds are
+		// replayed to new subscribers; either limit is ignored when zero, and
+		// nothing is replayed when both are. LastValueKey names the message
+		// field whose value keys the last-value cache.
+		Publisher struct {
+			ReplaySize   int    `koanf:"replay_size"`
+			ReplayWindow int    `koanf:"replay_window"`
+			LastValueKey string `koanf:"last_value_key"`
+		} `koanf:"publisher"`
+
+		// Compression compresses published bodies of at least Threshold bytes
+		// with Algorithm, which is one of gzip, zstd or snappy, or disabled
+		// when empty. Received bodies decompressing to more than
+		// MaxDecompressedSize bytes are refused.
+		Compression struct {
+			Algorithm           string `koanf:"algorithm"`
+			Threshold           int    `koanf:"threshold"`
+			MaxDecompressedSize int    `koanf:"max_decompressed_size"`
+		} `koanf:"compression"`
+
+		Topology Topology `koanf:"topology"`
 	} `koanf:"rabbitmq"`
 
 	Logger struct {
@@ -48,6 +172,45 @@ type Configuration struct {
 	} `koanf:"backoff"`
 }
 
+// Topology describes the exchanges, queues and bindings declared on startup.
+type Topology struct {
+	Exchanges []Exchange `koanf:"exchanges"`
+	Queues    []Queue    `koanf:"queues"`
+	Bindings  []Binding  `koanf:"bindings"`
+}
+
+type Exchange struct {
+	Name       string         `koanf:"name"`
+	Type       string         `koanf:"type"`
+	Durable    bool           `koanf:"durable"`
+	AutoDelete bool           `koanf:"auto_delete"`
+	Internal   bool           `koanf:"internal"`
+	Arguments  map[string]any `koanf:"arguments"`
+	// ContentType selects the codec for messages published to this exchange
+	ContentType string `koanf:"content_type"`
+	// AlternateExchange receives messages this exchange cannot route. It is
+	// declared as a durable fanout exchange bound to a queue of the same name.
+	AlternateExchange string `koanf:"alternate_exchange"`
+}
+
+type Queue struct {
+	Name       string `koanf:"name"`
+	Durable    bool   `koanf:"durable"`
+	AutoDelete bool   `koanf:"auto_delete"`
+	Exclusive  bool   `koanf:"exclusive"`
+	// Arguments such as x-max-length, x-message-ttl or x-queue-type
+	Arguments map[string]any `koanf:"arguments"`
+}
+
+// Binding binds Queue to Exchange once per routing key. Arguments carry the
+// header matches for headers exchanges.
+type Binding struct {
+	Exchange    string         `koanf:"exchange"`
+	Queue       string         `koanf:"queue"`
+	RoutingKeys []string       `koanf:"routing_keys"`
+	Arguments   map[string]any `koanf:"arguments"`
+}
+
 var (
 	// Use an unsafe pointer to hold the configuration for atomic swaps
 	configPtr unsafe.Pointer
@@ -128,6 +291,11 @@ func unmarshalIntoStruct() error {
 	return nil
 }
 
+// SetConfig replaces the active configuration, e.g. with one built by tests.
+func SetConfig(c *Configuration) {
+	atomic.StorePointer(&configPtr, unsafe.Pointer(c))
+}
+
 func GetConfig() *Configuration {
 	return (*Configuration)(atomic.LoadPointer(&configPtr))
 }
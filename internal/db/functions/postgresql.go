@@ -2,7 +2,113 @@ package functions
 
 const (
 	GenerateAndGetQueueName = `SELECT * from rabbitmq.generate_and_add_queue()`
-	GetAllQueues            = `SELECT * from rabbitmq.get_all_queues()`
 	DeleteQueue             = `SELECT * from rabbitmq.delete_queue($1)`
 	TruncateQueues          = `SELECT truncate_queues_table()`
 )
+
+// Message deduplication
+const (
+	CreateProcessedMessagesTable = `CREATE TABLE IF NOT EXISTS rabbitmq.processed_messages (
+		consumer     TEXT        NOT NULL,
+		message_id   TEXT        NOT NULL,
+		processed_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		PRIMARY KEY (consumer, message_id)
+	)`
+	// MarkMessageProcessed affects no rows when the message was already
+	// processed within the window given in seconds.
+	MarkMessageProcessed = `INSERT INTO rabbitmq.processed_messages AS pm (consumer, message_id)
+		VALUES ($1, $2)
+		ON CONFLICT (consumer, message_id) DO UPDATE SET processed_at = now()
+		WHERE pm.processed_at < now() - make_interval(secs => $3)`
+	PruneProcessedMessages = `DELETE FROM rabbitmq.processed_messages
+		WHERE processed_at < now() - make_interval(secs => $1)`
+)
+
+// Transactional outbox
+const (
+	CreateOutboxTable = `CREATE TABLE IF NOT EXISTS rabbitmq.outbox (
+		id               BIGSERIAL   PRIMARY KEY,
+		aggregate_id     TEXT        NOT NULL,
+		exchange         TEXT        NOT NULL,
+		routing_key      TEXT        NOT NULL DEFAULT '',
+		message_id       TEXT        NOT NULL,
+		correlation_id   TEXT        NOT NULL DEFAULT '',
+		message_type     TEXT        NOT NULL DEFAULT '',
+		content_type     TEXT        NOT NULL,
+		content_encoding TEXT        NOT NULL DEFAULT '',
+		headers          JSONB,
+		body             BYTEA       NOT NULL,
+		created_at       TIMESTAMPTZ NOT NULL DEFAULT now(),
+		sent_at          TIMESTAMPTZ
+	);
+	CREATE INDEX IF NOT EXISTS outbox_unsent_idx ON rabbitmq.outbox (id) WHERE sent_at IS NULL;
+	CREATE INDEX IF NOT EXISTS outbox_sent_at_idx ON rabbitmq.outbox (sent_at) WHERE sent_at IS NOT NULL`
+	InsertOutboxMessage = `INSERT INTO rabbitmq.outbox (aggregate_id, exchange, routing_key, message_id,
+		correlation_id, message_type, content_type, content_encoding, headers, body)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`
+	NotifyOutbox = `SELECT pg_notify('rabbitmq_outbox', '')`
+	ListenOutbox = `LISTEN rabbitmq_outbox`
+	// SelectOutboxBatch locks unsent rows together with an advisory lock on
+	// their aggregate, so an aggregate is only relayed by one instance at a time.
+	SelectOutboxBatch = `SELECT id, aggregate_id, exchange, routing_key, message_id, correlation_id,
+		message_type, content_type, content_encoding, headers, body, created_at
+		FROM rabbitmq.outbox
+		WHERE sent_at IS NULL
+		AND pg_try_advisory_xact_lock(hashtext('rabbitmq.outbox'), hashtext(aggregate_id))
+		ORDER BY id
+		LIMIT $1
+		FOR UPDATE SKIP LOCKED`
+	MarkOutboxSent = `UPDATE rabbitmq.outbox SET sent_at = now() WHERE id = ANY($1)`
+	// PruneOutbox deletes rows sent more than the given number of seconds ago.
+	PruneOutbox = `DELETE FROM rabbitmq.outbox WHERE sent_at < now() - make_interval(secs => $1)`
+)
+
+// Postgres broker backend
+const (
+	CreateBrokerTables = `CREATE TABLE IF NOT EXISTS rabbitmq.broker_messages (
+		id               BIGSERIAL   PRIMARY KEY,
+		exchange         TEXT        NOT NULL,
+		routing_key      TEXT        NOT NULL DEFAULT '',
+		message_id       TEXT        NOT NULL,
+		correlation_id   TEXT        NOT NULL DEFAULT '',
+		message_type     TEXT        NOT NULL DEFAULT '',
+		content_type     TEXT        NOT NULL,
+		content_encoding TEXT        NOT NULL DEFAULT '',
+		app_id           TEXT        NOT NULL DEFAULT '',
+		headers          JSONB,
+		body             BYTEA       NOT NULL,
+		created_at       TIMESTAMPTZ NOT NULL DEFAULT now()
+	);
+	CREATE INDEX IF NOT EXISTS broker_messages_created_at_idx ON rabbitmq.broker_messages (created_at);
+	CREATE TABLE IF NOT EXISTS rabbitmq.broker_offsets (
+		queue   TEXT   PRIMARY KEY,
+		last_id BIGINT NOT NULL
+	)`
+	// LockBrokerPublish serialises publishers, so message ids become visible
+	// in order and a reader never skips a row that commits later.
+	LockBrokerPublish   = `SELECT pg_advisory_xact_lock(hashtext('rabbitmq.broker_messages'))`
+	InsertBrokerMessage = `INSERT INTO rabbitmq.broker_messages (exchange, routing_key, message_id,
+		correlation_id, message_type, content_type, content_encoding, app_id, headers, body)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		RETURNING id, created_at`
+	NotifyBroker                = `SELECT pg_notify('rabbitmq_broker', $1)`
+	ListenBroker                = `LISTEN rabbitmq_broker`
+	SelectLatestBrokerMessageId = `SELECT COALESCE(max(id), 0) FROM rabbitmq.broker_messages`
+	SelectBrokerMessages        = `SELECT id, exchange, routing_key, message_id, correlation_id, message_type,
+		content_type, content_encoding, app_id, headers, body, created_at
+		FROM rabbitmq.broker_messages
+		WHERE id > $1
+		ORDER BY id
+		LIMIT $2`
+	// InitBrokerOffset starts a new durable queue at the latest message.
+	InitBrokerOffset = `INSERT INTO rabbitmq.broker_offsets (queue, last_id)
+		SELECT $1, COALESCE(max(id), 0) FROM rabbitmq.broker_messages
+		ON CONFLICT (queue) DO NOTHING`
+	SelectBrokerOffset = `SELECT last_id FROM rabbitmq.broker_offsets WHERE queue = $1`
+	UpdateBrokerOffset = `UPDATE rabbitmq.broker_offsets SET last_id = $2 WHERE queue = $1 AND last_id < $2`
+	// TryLockBrokerQueue takes a session lock, so a durable queue is consumed
+	// by one instance at a time.
+	TryLockBrokerQueue  = `SELECT pg_try_advisory_lock(hashtext('rabbitmq.broker_offsets'), hashtext($1))`
+	UnlockBrokerQueue   = `SELECT pg_advisory_unlock(hashtext('rabbitmq.broker_offsets'), hashtext($1))`
+	PruneBrokerMessages = `DELETE FROM rabbitmq.broker_messages WHERE created_at < now() - make_interval(secs => $1)`
+)
@@ -115,6 +115,24 @@ func PGReadSingleRow[T comparable](scanData *T, call string, data ...any) error
 	return row.Scan(scanData)
 }
 
+// Begin starts a transaction on a pooled connection. The caller must either
+// commit or roll it back.
+func (p *PostgresPoolClient) Begin(ctx context.Context) (pgx.Tx, error) {
+	if p.pool == nil {
+		return nil, errors.New("no connections available in the pool")
+	}
+	return p.pool.Begin(ctx)
+}
+
+// Acquire returns a dedicated connection, e.g. for LISTEN. The caller must
+// release it back to the pool.
+func (p *PostgresPoolClient) Acquire(ctx context.Context) (*pgxpool.Conn, error) {
+	if p.pool == nil {
+		return nil, errors.New("no connections available in the pool")
+	}
+	return p.pool.Acquire(ctx)
+}
+
 func (p *PostgresPoolClient) FlushPool() {
 	if p.pool == nil {
 		slog.Error("No connection to close")
@@ -0,0 +1,101 @@
+package messagebrokers
+
+import (
+	"context"
+	"fmt"
+	"github.com/Roh-Bot/rabbitmq-pub-sub/internal/config"
+	"github.com/Roh-Bot/rabbitmq-pub-sub/pkg/loggers"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	BackendRabbitMQ = "rabbitmq"
+	BackendMemory   = "memory"
+	BackendPostgres = "postgres"
+	BackendKafka    = "kafka"
+)
+
+var messageBroker MessageBroker
+
+// MessageBroker is the publish/subscribe API shared by every backend, so
+// application code does not depend on RabbitMQ being available.
+type MessageBroker interface {
+	// Publish encodes body and blocks until the broker has accepted it.
+	Publish(ctx context.Context, body any, opts ...PublishOption) error
+	// Consume runs handler for every message of the consumer's queue until the
+	// global context is cancelled, then calls wg.Done.
+	Consume(wg *sync.WaitGroup, handler Handler, opts ...ConsumerOption)
+	// Declare declares exchanges, queues and bindings.
+	Declare(topology config.Topology) error
+	// Publisher returns the in-process fan-out of received messages.
+	Publisher() *Publisher[map[string]any]
+	// Shutdown stops consumers and releases the broker's resources.
+	Shutdown()
+}
+
+var (
+	_ MessageBroker = (*RabbitMq)(nil)
+	_ MessageBroker = (*MemoryBroker)(nil)
+	_ MessageBroker = (*PostgresBroker)(nil)
+	_ MessageBroker = (*KafkaBroker)(nil)
+)
+
+// Connect starts the backend selected by broker.backend, RabbitMQ by default.
+func Connect() error {
+	switch backend := strings.ToLower(config.GetConfig().Broker.Backend); backend {
+	case "", BackendRabbitMQ:
+		if err := RabbitMQConnect(); err != nil {
+			return err
+		}
+		messageBroker = rabbitMQ
+	case BackendMemory:
+		m, err := NewMemoryBroker()
+		if err != nil {
+			return err
+		}
+		messageBroker = m
+	case BackendPostgres:
+		b, err := NewPostgresBroker()
+		if err != nil {
+			return err
+		}
+		messageBroker = b
+	case BackendKafka:
+		b, err := NewKafkaBroker()
+		if err != nil {
+			return err
+		}
+		messageBroker = b
+	default:
+		return fmt.Errorf("unsupported message broker backend %q", backend)
+	}
+	return nil
+}
+
+// Broker returns the backend started by Connect.
+func Broker() MessageBroker {
+	return messageBroker
+}
+
+// SendMessages publishes body to the configured exchange through b.
+func SendMessages(b MessageBroker, body map[string]any) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := b.Publish(ctx, body); err != nil {
+		loggers.Zap.Errorf("%s : %s", err, "Failed to publish a message")
+		return
+	}
+
+	log.Printf("MESSAGE SENT: Sent %v\n", body)
+}
+
+// ReceiveMessages consumes from a freshly generated queue and forwards every
+// decoded message to the broker's Publisher, wrapped in the DefaultMiddleware
+// chain. Use WithBindings to subscribe with routing keys or header matches.
+func ReceiveMessages(wg *sync.WaitGroup, b MessageBroker, opts ...ConsumerOption) {
+	Subscribe(wg, b, FanOut(b.Publisher()), append([]ConsumerOption{WithMiddleware(DefaultMiddleware()...)}, opts...)...)
+}
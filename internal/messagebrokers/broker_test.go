@@ -0,0 +1,118 @@
+package messagebrokers
+
+import (
+	"context"
+	"fmt"
+	"github.com/Roh-Bot/rabbitmq-pub-sub/internal/config"
+	"testing"
+)
+
+// BenchmarkSendMessages compares the old publish path, which re-bound every
+// registered queue before each publish, with a single publish to queues bound
+// once on declaration. The MemoryBroker stands in for RabbitMQ and every
+// QueueBind is a synchronous round trip to a goroutine owning the bindings,
+// like a channel RPC without the network.
+func BenchmarkSendMessages(b *testing.B) {
+	body := map[string]any{"id": 1, "message": "hello"}
+
+	for _, queues := range []int{1, 10, 100} {
+		setup := func(b *testing.B) (*MemoryBroker, []string) {
+			m, err := NewMemoryBroker()
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.Cleanup(m.Shutdown)
+			names := make([]string, queues)
+			topology := config.Topology{}
+			for i := range names {
+				names[i] = fmt.Sprintf("queue-%d", i)
+				topology.Queues = append(topology.Queues, config.Queue{Name: names[i]})
+				topology.Bindings = append(topology.Bindings, config.Binding{Exchange: testExchange, Queue: names[i]})
+			}
+			if err := m.Declare(topology); err != nil {
+				b.Fatal(err)
+			}
+			return m, names
+		}
+
+		b.Run(fmt.Sprintf("rebind/queues=%d", queues), func(b *testing.B) {
+			m, names := setup(b)
+			queueBind := bindServer(b, m)
+			ctx := context.Background()
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				for _, name := range names {
+					if err := queueBind(name); err != nil {
+						b.Fatal(err)
+					}
+				}
+				if err := m.Publish(ctx, body); err != nil {
+					b.Fatal(err)
+				}
+				drainEvery(b, m, i)
+			}
+		})
+
+		b.Run(fmt.Sprintf("single/queues=%d", queues), func(b *testing.B) {
+			m, _ := setup(b)
+			ctx := context.Background()
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := m.Publish(ctx, body); err != nil {
+					b.Fatal(err)
+				}
+				drainEvery(b, m, i)
+			}
+		})
+	}
+}
+
+// bindServer returns a QueueBind stand-in that binds queue to the test
+// exchange on a separate goroutine and waits for its reply.
+func bindServer(b *testing.B, m *MemoryBroker) func(queue string) error {
+	type bindRequest struct {
+		queue string
+		reply chan error
+	}
+	requests := make(chan bindRequest)
+	done := make(chan struct{})
+	b.Cleanup(func() { close(done) })
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case req := <-requests:
+				m.mutex.Lock()
+				err := m.bindLocked(req.queue, testExchange, "")
+				m.mutex.Unlock()
+				req.reply <- err
+			}
+		}
+	}()
+
+	reply := make(chan error)
+	return func(queue string) error {
+		requests <- bindRequest{queue: queue, reply: reply}
+		return <-reply
+	}
+}
+
+// drainEvery empties the queues of m every 1024 iterations, outside the
+// timer, so memory held by unconsumed messages does not skew the result.
+func drainEvery(b *testing.B, m *MemoryBroker, i int) {
+	if i%1024 != 1023 {
+		return
+	}
+	b.StopTimer()
+	m.mutex.Lock()
+	for _, q := range m.queues {
+		q.mutex.Lock()
+		q.ready = nil
+		q.mutex.Unlock()
+	}
+	m.mutex.Unlock()
+	b.StartTimer()
+}
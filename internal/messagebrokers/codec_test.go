@@ -0,0 +1,93 @@
+package messagebrokers
+
+import (
+	"errors"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+	"reflect"
+	"testing"
+)
+
+func TestCodecFor(t *testing.T) {
+	tests := []struct {
+		contentType string
+		want        string
+	}{
+		{"", ContentTypeJSON},
+		{ContentTypeJSON, ContentTypeJSON},
+		{"application/json; charset=utf-8", ContentTypeJSON},
+		{ContentTypeMsgPack, ContentTypeMsgPack},
+		{ContentTypeCBOR, ContentTypeCBOR},
+		{ContentTypeProtobuf, ContentTypeProtobuf},
+	}
+	for _, tt := range tests {
+		c, err := CodecFor(tt.contentType)
+		if err != nil {
+			t.Errorf("CodecFor(%q): %v", tt.contentType, err)
+			continue
+		}
+		if c.ContentType() != tt.want {
+			t.Errorf("CodecFor(%q) = %s, want %s", tt.contentType, c.ContentType(), tt.want)
+		}
+	}
+
+	if _, err := CodecFor("text/plain"); !errors.Is(err, ErrUnknownContentType) {
+		t.Errorf("CodecFor(text/plain) = %v, want ErrUnknownContentType", err)
+	}
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	type order struct {
+		Id    int
+		Items []string
+	}
+	in := order{Id: 7, Items: []string{"a", "b"}}
+
+	for _, contentType := range []string{ContentTypeJSON, ContentTypeMsgPack, ContentTypeCBOR} {
+		c, err := CodecFor(contentType)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := c.Marshal(in)
+		if err != nil {
+			t.Fatalf("%s: marshal: %v", contentType, err)
+		}
+		var out order
+		if err := c.Unmarshal(data, &out); err != nil {
+			t.Fatalf("%s: unmarshal: %v", contentType, err)
+		}
+		if !reflect.DeepEqual(in, out) {
+			t.Errorf("%s: round trip gave %+v, want %+v", contentType, out, in)
+		}
+	}
+}
+
+func TestProtobufCodec(t *testing.T) {
+	c, err := CodecFor(ContentTypeProtobuf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := c.Marshal(wrapperspb.String("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := new(wrapperspb.StringValue)
+	if err := c.Unmarshal(data, out); err != nil {
+		t.Fatal(err)
+	}
+	if !proto.Equal(out, wrapperspb.String("hello")) {
+		t.Errorf("round trip gave %v", out)
+	}
+
+	var allocated *wrapperspb.StringValue
+	if err := c.Unmarshal(data, &allocated); err != nil {
+		t.Fatal(err)
+	}
+	if allocated.GetValue() != "hello" {
+		t.Errorf("unmarshalling into a nil message pointer gave %v", allocated)
+	}
+
+	if _, err := c.Marshal(struct{}{}); err == nil {
+		t.Error("marshalling a value that is not a proto.Message succeeded")
+	}
+}
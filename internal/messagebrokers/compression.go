@@ -0,0 +1,183 @@
+package messagebrokers
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"github.com/Roh-Bot/rabbitmq-pub-sub/internal/config"
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	EncodingGzip   = "gzip"
+	EncodingZstd   = "zstd"
+	EncodingSnappy = "snappy"
+)
+
+// defaultMaxDecompressedSize caps decompressed bodies when
+// rabbitmq.compression.max_decompressed_size is not configured.
+const defaultMaxDecompressedSize = 64 << 20
+
+var (
+	ErrUnknownContentEncoding = errors.New("unsupported content encoding")
+	ErrDecompressedTooLarge   = errors.New("decompressed message exceeds the size limit")
+)
+
+// CompressionStats accumulates publish-side compression figures for an exchange.
+type CompressionStats struct {
+	Messages        uint64
+	OriginalBytes   uint64
+	CompressedBytes uint64
+	Duration        time.Duration
+}
+
+// Ratio returns compressed size over original size, or 0 if nothing was compressed.
+func (s CompressionStats) Ratio() float64 {
+	if s.OriginalBytes == 0 {
+		return 0
+	}
+	return float64(s.CompressedBytes) / float64(s.OriginalBytes)
+}
+
+var (
+	compressionStats = make(map[string]CompressionStats)
+	statsMutex       = new(sync.Mutex)
+
+	zstdEncoder, _ = zstd.NewWriter(nil)
+
+	// zstdDecoder is created on first use and whenever the size limit changes
+	zstdDecoder      *zstd.Decoder
+	zstdDecoderLimit int
+	zstdDecoderMutex = new(sync.Mutex)
+)
+
+// ExchangeCompressionStats returns the compression figures recorded for exchange.
+func ExchangeCompressionStats(exchange string) CompressionStats {
+	statsMutex.Lock()
+	defer statsMutex.Unlock()
+	return compressionStats[exchange]
+}
+
+func recordCompression(exchange string, original, compressed int, elapsed time.Duration) {
+	statsMutex.Lock()
+	defer statsMutex.Unlock()
+	s := compressionStats[exchange]
+	s.Messages++
+	s.OriginalBytes += uint64(original)
+	s.CompressedBytes += uint64(compressed)
+	s.Duration += elapsed
+	compressionStats[exchange] = s
+}
+
+// compress applies the configured algorithm to bodies of at least
+// rabbitmq.compression.threshold bytes and returns the content encoding to
+// set on the message, which is empty when the body was left as is, including
+// when compressing did not make it smaller.
+func compress(exchange string, body []byte) ([]byte, string, error) {
+	cfg := config.GetConfig().RabbitMQ.Compression
+	if cfg.Algorithm == "" || len(body) < cfg.Threshold {
+		return body, "", nil
+	}
+
+	start := time.Now()
+	var (
+		compressed []byte
+		err        error
+	)
+	switch cfg.Algorithm {
+	case EncodingGzip:
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err = w.Write(body); err == nil {
+			err = w.Close()
+		}
+		compressed = buf.Bytes()
+	case EncodingZstd:
+		compressed = zstdEncoder.EncodeAll(body, nil)
+	case EncodingSnappy:
+		compressed = snappy.Encode(nil, body)
+	default:
+		err = fmt.Errorf("%w: %q", ErrUnknownContentEncoding, cfg.Algorithm)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	if len(compressed) >= len(body) {
+		return body, "", nil
+	}
+
+	recordCompression(exchange, len(body), len(compressed), time.Since(start))
+	return compressed, cfg.Algorithm, nil
+}
+
+// maxDecompressedSize returns the largest body decompress will produce.
+func maxDecompressedSize() int {
+	if size := config.GetConfig().RabbitMQ.Compression.MaxDecompressedSize; size > 0 {
+		return size
+	}
+	return defaultMaxDecompressedSize
+}
+
+// decompress reverses compress for the given content encoding. Bodies that
+// would decompress to more than maxDecompressedSize bytes are refused.
+func decompress(encoding string, body []byte) ([]byte, error) {
+	limit := maxDecompressedSize()
+	switch encoding {
+	case "":
+		return body, nil
+	case EncodingGzip:
+		r, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		out, err := io.ReadAll(io.LimitReader(r, int64(limit)+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(out) > limit {
+			return nil, ErrDecompressedTooLarge
+		}
+		return out, nil
+	case EncodingZstd:
+		decoder, err := zstdDecoderFor(limit)
+		if err != nil {
+			return nil, err
+		}
+		out, err := decoder.DecodeAll(body, nil)
+		if errors.Is(err, zstd.ErrDecoderSizeExceeded) || errors.Is(err, zstd.ErrWindowSizeExceeded) {
+			return nil, ErrDecompressedTooLarge
+		}
+		return out, err
+	case EncodingSnappy:
+		n, err := snappy.DecodedLen(body)
+		if err != nil {
+			return nil, err
+		}
+		if n > limit {
+			return nil, ErrDecompressedTooLarge
+		}
+		return snappy.Decode(nil, body)
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnknownContentEncoding, encoding)
+	}
+}
+
+// zstdDecoderFor returns the shared zstd decoder refusing output above limit.
+func zstdDecoderFor(limit int) (*zstd.Decoder, error) {
+	zstdDecoderMutex.Lock()
+	defer zstdDecoderMutex.Unlock()
+	if zstdDecoder == nil || zstdDecoderLimit != limit {
+		decoder, err := zstd.NewReader(nil, zstd.WithDecoderMaxMemory(uint64(limit)))
+		if err != nil {
+			return nil, err
+		}
+		zstdDecoder, zstdDecoderLimit = decoder, limit
+	}
+	return zstdDecoder, nil
+}
@@ -0,0 +1,111 @@
+package messagebrokers
+
+import (
+	"bytes"
+	"errors"
+	"github.com/Roh-Bot/rabbitmq-pub-sub/internal/config"
+	"testing"
+)
+
+func TestCompressRoundTrip(t *testing.T) {
+	body := bytes.Repeat([]byte("compressible "), 100)
+	for _, algorithm := range []string{EncodingGzip, EncodingZstd, EncodingSnappy} {
+		t.Run(algorithm, func(t *testing.T) {
+			setConfig(t, func(c *config.Configuration) {
+				c.RabbitMQ.Compression.Algorithm = algorithm
+			})
+			exchange := "compress-" + algorithm
+			before := ExchangeCompressionStats(exchange)
+			compressed, encoding, err := compress(exchange, body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if encoding != algorithm {
+				t.Fatalf("encoding = %q, want %q", encoding, algorithm)
+			}
+			if len(compressed) >= len(body) {
+				t.Fatalf("compressed %d bytes to %d", len(body), len(compressed))
+			}
+			out, err := decompress(encoding, compressed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(out, body) {
+				t.Fatal("round trip changed the body")
+			}
+
+			stats := ExchangeCompressionStats(exchange)
+			if stats.Messages-before.Messages != 1 ||
+				stats.OriginalBytes-before.OriginalBytes != uint64(len(body)) ||
+				stats.CompressedBytes-before.CompressedBytes != uint64(len(compressed)) {
+				t.Errorf("stats went from %+v to %+v", before, stats)
+			}
+		})
+	}
+}
+
+func TestCompressLeavesBodyAsIs(t *testing.T) {
+	setConfig(t, func(c *config.Configuration) {
+		c.RabbitMQ.Compression.Algorithm = EncodingGzip
+		c.RabbitMQ.Compression.Threshold = 32
+	})
+
+	tests := map[string][]byte{
+		"below threshold": bytes.Repeat([]byte("a"), 31),
+		"not smaller":     []byte("0123456789abcdefghijklmnopqrstuvwxyz"),
+	}
+	for name, body := range tests {
+		out, encoding, err := compress("as-is", body)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if encoding != "" || !bytes.Equal(out, body) {
+			t.Errorf("%s: body compressed with %q", name, encoding)
+		}
+	}
+	if stats := ExchangeCompressionStats("as-is"); stats.Messages != 0 {
+		t.Errorf("recorded %d compressed messages", stats.Messages)
+	}
+}
+
+func TestCompressDisabledByDefault(t *testing.T) {
+	body := bytes.Repeat([]byte("compressible "), 100)
+	out, encoding, err := compress("disabled", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if encoding != "" || !bytes.Equal(out, body) {
+		t.Errorf("body compressed with %q", encoding)
+	}
+}
+
+func TestDecompressTooLarge(t *testing.T) {
+	body := bytes.Repeat([]byte("a"), 4096)
+	for _, algorithm := range []string{EncodingGzip, EncodingZstd, EncodingSnappy} {
+		t.Run(algorithm, func(t *testing.T) {
+			setConfig(t, func(c *config.Configuration) {
+				c.RabbitMQ.Compression.Algorithm = algorithm
+				c.RabbitMQ.Compression.MaxDecompressedSize = 1024
+			})
+			compressed, encoding, err := compress("too-large", body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := decompress(encoding, compressed); !errors.Is(err, ErrDecompressedTooLarge) {
+				t.Errorf("decompress = %v, want ErrDecompressedTooLarge", err)
+			}
+		})
+	}
+}
+
+func TestDecompressUnknownEncoding(t *testing.T) {
+	if _, err := decompress("br", []byte("x")); !errors.Is(err, ErrUnknownContentEncoding) {
+		t.Errorf("decompress(br) = %v, want ErrUnknownContentEncoding", err)
+	}
+	setConfig(t, func(c *config.Configuration) {
+		c.RabbitMQ.Compression.Algorithm = "br"
+	})
+	if _, _, err := compress("unknown", []byte("x")); !errors.Is(err, ErrUnknownContentEncoding) {
+		t.Errorf("compress with br = %v, want ErrUnknownContentEncoding", err)
+	}
+}
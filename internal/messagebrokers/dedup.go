@@ -0,0 +1,107 @@
+package messagebrokers
+
+import (
+	"context"
+	"github.com/Roh-Bot/rabbitmq-pub-sub/internal/config"
+	"github.com/Roh-Bot/rabbitmq-pub-sub/internal/db"
+	"github.com/Roh-Bot/rabbitmq-pub-sub/internal/db/functions"
+	"github.com/Roh-Bot/rabbitmq-pub-sub/pkg/global"
+	"github.com/Roh-Bot/rabbitmq-pub-sub/pkg/loggers"
+	"github.com/jackc/pgx/v5"
+	"github.com/rabbitmq/amqp091-go"
+	"log"
+	"sync"
+	"time"
+)
+
+// TxHandler processes a delivery inside the transaction that marks it as
+// processed, so the handler's own writes commit or roll back together with it.
+type TxHandler func(ctx context.Context, tx pgx.Tx, deliver amqp091.Delivery) Acknowledgement
+
+// Deduplicator records processed message ids per consumer in Postgres and
+// skips redeliveries seen within the configured window.
+type Deduplicator struct {
+	consumer string
+	window   time.Duration
+}
+
+// NewDeduplicator creates the bookkeeping table if needed. consumer scopes
+// the recorded ids, so different consumers may process the same message.
+func NewDeduplicator(consumer string) (*Deduplicator, error) {
+	if err := db.Postgres().ExecNonQuery(functions.CreateProcessedMessagesTable); err != nil {
+		return nil, err
+	}
+	return &Deduplicator{
+		consumer: consumer,
+		window:   time.Duration(config.GetConfig().RabbitMQ.Dedup.Window) * time.Second,
+	}, nil
+}
+
+// Handler wraps handler so it only runs for messages not yet processed. The
+// transaction is committed only when handler acks; duplicates are acked
+// without calling it. Messages without a MessageId cannot be deduplicated
+// and are always handled.
+func (d *Deduplicator) Handler(handler TxHandler) DeliveryHandler {
+	return func(ctx context.Context, deliver amqp091.Delivery) Acknowledgement {
+		tx, err := db.Postgres().Begin(ctx)
+		if err != nil {
+			loggers.Zap.Errorf("PG Error: %s", err.Error())
+			return Requeue
+		}
+		defer func() {
+			_ = tx.Rollback(context.Background())
+		}()
+
+		if deliver.MessageId != "" {
+			tag, err := tx.Exec(ctx, functions.MarkMessageProcessed, d.consumer, deliver.MessageId, d.window.Seconds())
+			if err != nil {
+				loggers.Zap.Errorf("PG Error: %s", err.Error())
+				return Requeue
+			}
+			if tag.RowsAffected() == 0 {
+				log.Printf("Skipping duplicate message %s for consumer %s", deliver.MessageId, d.consumer)
+				return Ack
+			}
+		}
+
+		ack := handler(ctx, tx, deliver)
+		if ack != Ack {
+			return ack
+		}
+		if err := tx.Commit(ctx); err != nil {
+			loggers.Zap.Errorf("PG Error: %s", err.Error())
+			return Requeue
+		}
+		return Ack
+	}
+}
+
+// Prune deletes the ids recorded before the deduplication window.
+func (d *Deduplicator) Prune() error {
+	return db.Postgres().ExecNonQuery(functions.PruneProcessedMessages, d.window.Seconds())
+}
+
+// RunPruner prunes old ids every rabbitmq.dedup.prune_interval seconds until
+// the global context is cancelled.
+func (d *Deduplicator) RunPruner(wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	interval := time.Duration(config.GetConfig().RabbitMQ.Dedup.PruneInterval) * time.Second
+	if interval <= 0 {
+		interval = time.Hour
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-global.CancellationContext().Done():
+			log.Println("Dedup pruner stopped")
+			return
+		case <-ticker.C:
+			if err := d.Prune(); err != nil {
+				loggers.Zap.Errorf("PG Error: %s", err.Error())
+			}
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package messagebrokers
+
+import (
+	"github.com/google/uuid"
+	"github.com/rabbitmq/amqp091-go"
+	"reflect"
+	"time"
+)
+
+// HeaderInstanceId carries the id of the process instance that published a message.
+const HeaderInstanceId = "x-instance-id"
+
+// instanceId identifies this process for the lifetime of the program.
+var instanceId = NewMessageId()
+
+// Envelope carries a decoded body together with the message properties. On
+// consume, Delivery holds the raw delivery the envelope was built from.
+type Envelope[T any] struct {
+	MessageId     string
+	CorrelationId string
+	Type          string
+	AppId         string
+	InstanceId    string
+	Timestamp     time.Time
+	Headers       amqp091.Table
+	Body          T
+
+	Delivery amqp091.Delivery
+}
+
+// NewMessageId returns a time-ordered UUIDv7 string.
+func NewMessageId() string {
+	return uuid.Must(uuid.NewV7()).String()
+}
+
+// InstanceId returns the producer instance id stamped on every published message.
+func InstanceId() string {
+	return instanceId
+}
+
+func newEnvelope[T any](body T, deliver amqp091.Delivery) Envelope[T] {
+	instance, _ := deliver.Headers[HeaderInstanceId].(string)
+	return Envelope[T]{
+		MessageId:     deliver.MessageId,
+		CorrelationId: deliver.CorrelationId,
+		Type:          deliver.Type,
+		AppId:         deliver.AppId,
+		InstanceId:    instance,
+		Timestamp:     deliver.Timestamp,
+		Headers:       deliver.Headers,
+		Body:          body,
+		Delivery:      deliver,
+	}
+}
+
+// schemaType names the schema of body after its Go type. Unnamed types such
+// as map[string]any have no schema type.
+func schemaType(body any) string {
+	t := reflect.TypeOf(body)
+	for t != nil && t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t == nil || t.Name() == "" {
+		return ""
+	}
+	return t.String()
+}
@@ -0,0 +1,531 @@
+package messagebrokers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Roh-Bot/rabbitmq-pub-sub/internal/config"
+	"github.com/Roh-Bot/rabbitmq-pub-sub/pkg/global"
+	"github.com/Roh-Bot/rabbitmq-pub-sub/pkg/loggers"
+	"github.com/rabbitmq/amqp091-go"
+	"github.com/twmb/franz-go/pkg/kadm"
+	"github.com/twmb/franz-go/pkg/kerr"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultKafkaClientId = "rabbitmq-pub-sub"
+
+	// kafkaHeaderPrefix marks record headers carrying AMQP properties.
+	// Application headers are stored under their own name, JSON encoded.
+	kafkaHeaderPrefix          = "amqp-"
+	kafkaHeaderExchange        = kafkaHeaderPrefix + "exchange"
+	kafkaHeaderRoutingKey      = kafkaHeaderPrefix + "routing-key"
+	kafkaHeaderContentType     = kafkaHeaderPrefix + "content-type"
+	kafkaHeaderContentEncoding = kafkaHeaderPrefix + "content-encoding"
+	kafkaHeaderMessageId       = kafkaHeaderPrefix + "message-id"
+	kafkaHeaderCorrelationId   = kafkaHeaderPrefix + "correlation-id"
+	kafkaHeaderType            = kafkaHeaderPrefix + "type"
+	kafkaHeaderAppId           = kafkaHeaderPrefix + "app-id"
+)
+
+// KafkaBroker is a MessageBroker on top of Kafka. Every exchange is a topic,
+// and messages sent to the default exchange go to the topic named by their
+// routing key. A queue is a consumer group subscribed to the topics of its
+// bindings and to its own topic; routing keys are matched on the consumer
+// side. Offsets are committed once the handler acked or rejected a message,
+// so each consumer handles one message at a time per group.
+type KafkaBroker struct {
+	p         *Publisher[map[string]any]
+	routes    *routingTable
+	client    *kgo.Client
+	consumers atomic.Uint64
+
+	partitions        int32
+	replicationFactor int16
+	done              chan struct{}
+	once              sync.Once
+}
+
+// NewKafkaBroker connects the producer to broker.kafka.brokers and creates
+// the topics of the configured topology.
+func NewKafkaBroker() (*KafkaBroker, error) {
+	cfg := config.GetConfig().Broker.Kafka
+	b := &KafkaBroker{
+		p:                 NewPublisher(publisherOptions()...),
+		routes:            newRoutingTable(),
+		partitions:        int32(cfg.Partitions),
+		replicationFactor: int16(cfg.ReplicationFactor),
+		done:              make(chan struct{}),
+	}
+	// -1 lets the cluster pick its defaults
+	if b.partitions <= 0 {
+		b.partitions = -1
+	}
+	if b.replicationFactor <= 0 {
+		b.replicationFactor = -1
+	}
+
+	client, err := kgo.NewClient(kafkaOptions()...)
+	if err != nil {
+		return nil, err
+	}
+	b.client = client
+
+	if err := b.Declare(config.GetConfig().RabbitMQ.Topology); err != nil {
+		client.Close()
+		return nil, err
+	}
+
+	log.Printf("Started Kafka message broker on %s", strings.Join(cfg.Brokers, ","))
+	return b, nil
+}
+
+// kafkaOptions returns the client options shared by the producer and every
+// consumer.
+func kafkaOptions(opts ...kgo.Opt) []kgo.Opt {
+	cfg := config.GetConfig().Broker.Kafka
+	clientId := cfg.ClientId
+	if clientId == "" {
+		clientId = defaultKafkaClientId
+	}
+	return append([]kgo.Opt{
+		kgo.SeedBrokers(cfg.Brokers...),
+		kgo.ClientID(clientId),
+	}, opts...)
+}
+
+func (b *KafkaBroker) Publisher() *Publisher[map[string]any] {
+	return b.p
+}
+
+// Declare records exchanges and the bindings of named queues, and creates a
+// topic for every exchange and queue that does not have one yet.
+func (b *KafkaBroker) Declare(topology config.Topology) error {
+	if err := b.routes.declare(topology); err != nil {
+		return err
+	}
+
+	topics := make([]string, 0, len(topology.Exchanges)+len(topology.Queues))
+	for _, e := range topology.Exchanges {
+		topics = append(topics, e.Name)
+	}
+	for _, q := range topology.Queues {
+		topics = append(topics, q.Name)
+	}
+	return b.createTopics(topics...)
+}
+
+func (b *KafkaBroker) createTopics(topics ...string) error {
+	if len(topics) == 0 {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	resp, err := kadm.NewClient(b.client).CreateTopics(ctx, b.partitions, b.replicationFactor, nil, topics...)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, t := range resp.Sorted() {
+		if t.Err != nil && !errors.Is(t.Err, kerr.TopicAlreadyExists) {
+			errs = append(errs, fmt.Errorf("creating topic %s: %w", t.Topic, t.Err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Publish encodes body like RabbitMq.Publish and blocks until the record is
+// acknowledged by the cluster. The routing key becomes the record key, so
+// messages with the same key stay in order.
+func (b *KafkaBroker) Publish(ctx context.Context, body any, opts ...PublishOption) error {
+	o, msg, err := preparePublishing(ctx, body, opts)
+	if err != nil {
+		return err
+	}
+	if err := b.publish(ctx, o.exchange, o.routingKey, msg); err != nil {
+		return &PublishError{Exchange: o.exchange, Err: err}
+	}
+	return nil
+}
+
+func (b *KafkaBroker) publish(ctx context.Context, exchange, key string, msg amqp091.Publishing) error {
+	select {
+	case <-b.done:
+		return ErrConnectionClosed
+	default:
+	}
+	if err := b.routes.checkExchange(exchange); err != nil {
+		return err
+	}
+
+	topic := exchange
+	if topic == "" {
+		topic = key
+	}
+	record, err := kafkaRecord(topic, exchange, key, msg)
+	if err != nil {
+		return err
+	}
+	return b.client.ProduceSync(ctx, record).FirstErr()
+}
+
+// kafkaRecord stores msg as a record of topic, keeping its properties in
+// headers so consumers can rebuild the delivery.
+func kafkaRecord(topic, exchange, key string, msg amqp091.Publishing) (*kgo.Record, error) {
+	record := &kgo.Record{
+		Topic:     topic,
+		Key:       []byte(key),
+		Value:     msg.Body,
+		Timestamp: msg.Timestamp,
+		Headers: []kgo.RecordHeader{
+			{Key: kafkaHeaderExchange, Value: []byte(exchange)},
+			{Key: kafkaHeaderRoutingKey, Value: []byte(key)},
+		},
+	}
+	for name, value := range map[string]string{
+		kafkaHeaderContentType:     msg.ContentType,
+		kafkaHeaderContentEncoding: msg.ContentEncoding,
+		kafkaHeaderMessageId:       msg.MessageId,
+		kafkaHeaderCorrelationId:   msg.CorrelationId,
+		kafkaHeaderType:            msg.Type,
+		kafkaHeaderAppId:           msg.AppId,
+	} {
+		if value != "" {
+			record.Headers = append(record.Headers, kgo.RecordHeader{Key: name, Value: []byte(value)})
+		}
+	}
+	for name, value := range msg.Headers {
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			return nil, fmt.Errorf("encoding header %s: %w", name, err)
+		}
+		record.Headers = append(record.Headers, kgo.RecordHeader{Key: name, Value: encoded})
+	}
+	return record, nil
+}
+
+// kafkaDelivery rebuilds the delivery of record. Records written by other
+// producers have no AMQP properties; they are treated as published to the
+// exchange of their topic, with the record key as routing key. Headers that
+// are not JSON are passed on as strings.
+func kafkaDelivery(record *kgo.Record) amqp091.Delivery {
+	d := amqp091.Delivery{
+		Exchange:   record.Topic,
+		RoutingKey: string(record.Key),
+		Timestamp:  record.Timestamp.UTC(),
+		Body:       record.Value,
+	}
+	for _, h := range record.Headers {
+		value := string(h.Value)
+		switch h.Key {
+		case kafkaHeaderExchange:
+			d.Exchange = value
+		case kafkaHeaderRoutingKey:
+			d.RoutingKey = value
+		case kafkaHeaderContentType:
+			d.ContentType = value
+		case kafkaHeaderContentEncoding:
+			d.ContentEncoding = value
+		case kafkaHeaderMessageId:
+			d.MessageId = value
+		case kafkaHeaderCorrelationId:
+			d.CorrelationId = value
+		case kafkaHeaderType:
+			d.Type = value
+		case kafkaHeaderAppId:
+			d.AppId = value
+		default:
+			if d.Headers == nil {
+				d.Headers = make(amqp091.Table)
+			}
+			var decoded any
+			if err := json.Unmarshal(h.Value, &decoded); err != nil {
+				decoded = value
+			}
+			d.Headers[h.Key] = decoded
+		}
+	}
+	return d
+}
+
+// Consume follows RabbitMq.Consume: without WithQueue the consumer joins a
+// group of its own, starts at the end of its topics and only sees messages
+// of the configured exchange unless WithBindings is given. Consumers sharing
+// a queue name share a consumer group and split the topics' partitions.
+func (b *KafkaBroker) Consume(wg *sync.WaitGroup, handler Handler, opts ...ConsumerOption) {
+	defer wg.Done()
+
+	o := newConsumerOptions(opts)
+	handler = Chain(handler, o.middlewares...)
+
+	named := o.queue != ""
+	queueName := o.queue
+	if !named {
+		queueName = "amq.gen-" + NewMessageId()
+	}
+	c := &kafkaConsumer{
+		b:      b,
+		router: b.routes.router(queueName, named, o.bindings),
+		ack:    newSerialAcknowledger(queueName, fmt.Sprintf("ctag-%d", b.consumers.Add(1)), o.autoAck),
+		done:   make(chan struct{}),
+		mutex:  new(sync.Mutex),
+		owned:  make(map[string]map[int32]bool),
+	}
+
+	topics := c.router.exchangeNames()
+	if named {
+		if err := b.createTopics(queueName); err != nil {
+			loggers.Zap.Errorf("Kafka Error: %s", err.Error())
+		}
+		topics = append(topics, queueName)
+	}
+	client, err := kgo.NewClient(kafkaOptions(
+		kgo.ConsumerGroup(queueName),
+		kgo.ConsumeTopics(topics...),
+		kgo.ConsumeResetOffset(kgo.NewOffset().AtEnd()),
+		kgo.AutoCommitMarks(),
+		kgo.OnPartitionsAssigned(c.assigned),
+		kgo.OnPartitionsRevoked(c.revoked),
+		kgo.OnPartitionsLost(c.lost),
+	)...)
+	if err != nil {
+		loggers.Zap.Errorf("Kafka Error: %s", err.Error())
+		return
+	}
+	c.client = client
+
+	ctx, cancel := context.WithCancel(global.CancellationContext())
+	defer cancel()
+	go func() {
+		select {
+		case <-b.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	msgs := make(chan amqp091.Delivery)
+	go c.run(ctx, msgs)
+
+	log.Printf(" [*] Waiting for messages from queue: %s. To exit press CTRL+C", queueName)
+	receive(queueName, msgs, handler, o, c.ack.retry)
+
+	// The consumer group of a generated queue is not reused. It is deleted
+	// with a client of its own, as the producer may be closed by now.
+	if !named {
+		cancel()
+		<-c.done
+		c.deleteGroup()
+	}
+	log.Printf("Kafka receiver for queue %s stopped", queueName)
+}
+
+// Shutdown stops all consumers, flushes and closes the producer and stops
+// the Publisher.
+func (b *KafkaBroker) Shutdown() {
+	b.once.Do(func() {
+		log.Println("Closing Kafka message broker...")
+		close(b.done)
+		b.client.Close()
+		b.p.Shutdown()
+		log.Println("Kafka message broker closed")
+	})
+}
+
+// kafkaConsumer reads the records of one Consume call.
+type kafkaConsumer struct {
+	b      *KafkaBroker
+	router *consumerRouter
+	ack    *serialAcknowledger
+	client *kgo.Client
+	tag    uint64
+	// done is closed once the client is closed
+	done chan struct{}
+
+	// mutex guards the partitions the group assigned to the consumer and
+	// the record being delivered, as rebalances run alongside the delivery
+	mutex          *sync.Mutex
+	owned          map[string]map[int32]bool
+	inFlight       *kgo.Record
+	cancelDelivery context.CancelFunc
+}
+
+// assigned records the partitions the group assigned to the consumer.
+func (c *kafkaConsumer) assigned(_ context.Context, _ *kgo.Client, assigned map[string][]int32) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for topic, partitions := range assigned {
+		if c.owned[topic] == nil {
+			c.owned[topic] = make(map[int32]bool)
+		}
+		for _, partition := range partitions {
+			c.owned[topic][partition] = true
+		}
+	}
+}
+
+// revoked commits the offsets marked so far before the group hands the
+// partitions to another member.
+func (c *kafkaConsumer) revoked(ctx context.Context, client *kgo.Client, revoked map[string][]int32) {
+	c.release(revoked)
+	if err := client.CommitMarkedOffsets(ctx); err != nil && ctx.Err() == nil {
+		loggers.Zap.Errorf("Kafka Error: %s", err.Error())
+	}
+}
+
+// lost forgets partitions the consumer lost without a chance to commit.
+func (c *kafkaConsumer) lost(_ context.Context, _ *kgo.Client, lost map[string][]int32) {
+	c.release(lost)
+}
+
+// release forgets partitions that are no longer the consumer's and stops
+// the delivery of a record from one of them, which their new owner
+// delivers again.
+func (c *kafkaConsumer) release(partitions map[string][]int32) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for topic, released := range partitions {
+		for _, partition := range released {
+			delete(c.owned[topic], partition)
+			if c.inFlight != nil && c.inFlight.Topic == topic && c.inFlight.Partition == partition {
+				c.cancelDelivery()
+			}
+		}
+	}
+}
+
+// begin returns the context record is delivered with, or false if its
+// partition was revoked since it was fetched.
+func (c *kafkaConsumer) begin(ctx context.Context, record *kgo.Record) (context.Context, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if !c.owned[record.Topic][record.Partition] {
+		return nil, false
+	}
+	ctx, c.cancelDelivery = context.WithCancel(ctx)
+	c.inFlight = record
+	return ctx, true
+}
+
+// end releases the context of the record being delivered.
+func (c *kafkaConsumer) end() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.cancelDelivery()
+	c.inFlight = nil
+	c.cancelDelivery = nil
+}
+
+// mark marks record for commit unless its partition was revoked, as the
+// offsets of a revoked partition belong to its new owner.
+func (c *kafkaConsumer) mark(record *kgo.Record) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.owned[record.Topic][record.Partition] {
+		c.client.MarkCommitRecords(record)
+	}
+}
+
+// run delivers records to msgs until ctx is cancelled. Every record is
+// marked for commit once it was settled, or skipped because the consumer is
+// not bound to it; marked offsets are committed in the background, when
+// partitions are revoked and when the consumer stops. Rebalances are not
+// held up by a record being handled or retried.
+func (c *kafkaConsumer) run(ctx context.Context, msgs chan<- amqp091.Delivery) {
+	defer close(c.done)
+	defer close(msgs)
+	defer func() {
+		commitCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := c.client.CommitMarkedOffsets(commitCtx); err != nil {
+			loggers.Zap.Errorf("Kafka Error: %s", err.Error())
+		}
+		c.client.Close()
+	}()
+
+	for {
+		fetches := c.client.PollFetches(ctx)
+		if ctx.Err() != nil || fetches.IsClientClosed() {
+			return
+		}
+		fetches.EachError(func(topic string, partition int32, err error) {
+			loggers.Zap.Errorf("Kafka Error: %s [%d]: %s", topic, partition, err.Error())
+		})
+
+		for iter := fetches.RecordIter(); !iter.Done(); {
+			record := iter.Next()
+			if err := c.deliver(ctx, msgs, record); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// deliver hands record to the handler if the consumer is bound to it and
+// waits until it is settled, then marks it for commit. Records of the
+// queue's own topic without AMQP properties were sent to the queue directly.
+// It only returns an error once ctx is done.
+func (c *kafkaConsumer) deliver(ctx context.Context, msgs chan<- amqp091.Delivery, record *kgo.Record) error {
+	d := kafkaDelivery(record)
+	if c.router.named && record.Topic == c.router.queue && !hasKafkaHeader(record, kafkaHeaderExchange) {
+		d.Exchange = ""
+		d.RoutingKey = c.router.queue
+	}
+	if !c.router.routes(d.Exchange, d.RoutingKey) {
+		c.mark(record)
+		return nil
+	}
+
+	deliveryCtx, ok := c.begin(ctx, record)
+	if !ok {
+		return nil
+	}
+	c.tag++
+	d.DeliveryTag = c.tag
+	err := c.ack.deliver(deliveryCtx, msgs, d)
+	c.end()
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err == nil {
+		c.mark(record)
+	}
+	return nil
+}
+
+// deleteGroup deletes the consumer group of a stopped consumer.
+func (c *kafkaConsumer) deleteGroup() {
+	admin, err := kgo.NewClient(kafkaOptions()...)
+	if err != nil {
+		loggers.Zap.Errorf("Kafka Error: %s", err.Error())
+		return
+	}
+	defer admin.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	resp, err := kadm.NewClient(admin).DeleteGroups(ctx, c.router.queue)
+	if err == nil {
+		err = resp.Error()
+	}
+	if err != nil {
+		loggers.Zap.Errorf("Kafka Error: %s", err.Error())
+	}
+}
+
+func hasKafkaHeader(record *kgo.Record, key string) bool {
+	for _, h := range record.Headers {
+		if h.Key == key {
+			return true
+		}
+	}
+	return false
+}
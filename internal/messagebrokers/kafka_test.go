@@ -0,0 +1,384 @@
+package messagebrokers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/Roh-Bot/rabbitmq-pub-sub/internal/config"
+	"github.com/rabbitmq/amqp091-go"
+	"github.com/twmb/franz-go/pkg/kadm"
+	"github.com/twmb/franz-go/pkg/kfake"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestKafkaBroker starts a single-broker kfake cluster and a KafkaBroker
+// connected to it. The returned admin client stays usable after the broker
+// is shut down.
+func newTestKafkaBroker(t *testing.T, modify func(c *config.Configuration)) (*KafkaBroker, *kadm.Client) {
+	t.Helper()
+	cluster, err := kfake.NewCluster(kfake.NumBrokers(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(cluster.Close)
+
+	setConfig(t, func(c *config.Configuration) {
+		c.Broker.Backend = "kafka"
+		c.Broker.Kafka.Brokers = cluster.ListenAddrs()
+		c.Broker.Kafka.Partitions = 1
+		c.Broker.Kafka.ReplicationFactor = 1
+		modify(c)
+	})
+
+	client, err := kgo.NewClient(kgo.SeedBrokers(cluster.ListenAddrs()...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(client.Close)
+
+	b, err := NewKafkaBroker()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(b.Shutdown)
+	return b, kadm.NewClient(client)
+}
+
+// startKafkaConsumer runs Consume until the broker is shut down.
+func startKafkaConsumer(t *testing.T, b *KafkaBroker, handler Handler, opts ...ConsumerOption) *sync.WaitGroup {
+	t.Helper()
+	wg := new(sync.WaitGroup)
+	wg.Add(1)
+	go b.Consume(wg, handler, opts...)
+	t.Cleanup(func() {
+		b.Shutdown()
+		wg.Wait()
+	})
+	return wg
+}
+
+// seedOffsets commits offset 0 of every topic for group, so its consumer
+// starts at the beginning instead of at the end of the topics.
+func seedOffsets(t *testing.T, admin *kadm.Client, group string, topics ...string) {
+	t.Helper()
+	offsets := make(kadm.Offsets)
+	for _, topic := range topics {
+		offsets.AddOffset(topic, 0, 0, -1)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	resp, err := admin.CommitOffsets(ctx, group, offsets)
+	if err == nil {
+		err = resp.Error()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// committedOffset returns the offset group committed for partition 0 of
+// topic, or -1 if there is none.
+func committedOffset(t *testing.T, admin *kadm.Client, group, topic string) int64 {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	resp, err := admin.FetchOffsets(ctx, group)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o, ok := resp.Lookup(topic, 0)
+	if !ok || o.Err != nil {
+		return -1
+	}
+	return o.At
+}
+
+// awaitCommittedOffset waits until group committed want for topic.
+func awaitCommittedOffset(t *testing.T, admin *kadm.Client, group, topic string, want int64) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		got := committedOffset(t, admin, group, topic)
+		if got == want {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("committed offset of %s on %s is %d, want %d", group, topic, got, want)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestKafkaBrokerRouting(t *testing.T) {
+	b, admin := newTestKafkaBroker(t, func(c *config.Configuration) {})
+	err := b.Declare(config.Topology{
+		Exchanges: []config.Exchange{{Name: "events", Type: amqp091.ExchangeTopic}},
+		Queues:    []config.Queue{{Name: "audit"}},
+		Bindings:  []config.Binding{{Exchange: "events", Queue: "audit", RoutingKeys: []string{"orders.*"}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	seedOffsets(t, admin, "audit", "events", "audit")
+
+	ctx := context.Background()
+	for _, publish := range []struct {
+		exchange, key string
+	}{
+		{"events", "orders.created"},
+		{"events", "users.created"},
+		{"events", "orders.eu.created"},
+		{"", "audit"},
+		{testExchange, "orders.created"},
+	} {
+		body := map[string]any{"exchange": publish.exchange, "key": publish.key}
+		if err := b.Publish(ctx, body, WithExchange(publish.exchange), WithRoutingKey(publish.key), WithHeaders(amqp091.Table{"source": "test"})); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.Publish(ctx, map[string]any{}, WithExchange("missing")); err == nil {
+		t.Error("publishing to an undeclared exchange succeeded")
+	}
+
+	received := make(chan amqp091.Delivery, 10)
+	startKafkaConsumer(t, b, DeliveryHandler(func(_ context.Context, d amqp091.Delivery) Acknowledgement {
+		received <- d
+		return Ack
+	}), WithQueue("audit"), WithAutoAck(false))
+
+	var got []string
+	for i := 0; i < 2; i++ {
+		d := receiveWithin(t, received, 10*time.Second)
+		got = append(got, d.Exchange+"/"+d.RoutingKey)
+		if d.ContentType != ContentTypeJSON || d.Headers["source"] != "test" {
+			t.Errorf("delivery lost its properties: content type %q, headers %v", d.ContentType, d.Headers)
+		}
+	}
+	receiveNone(t, received, 500*time.Millisecond)
+
+	sort.Strings(got)
+	if want := []string{"/audit", "events/orders.created"}; strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("received %v, want %v", got, want)
+	}
+}
+
+func TestKafkaBrokerCommitsAfterSettlement(t *testing.T) {
+	b, admin := newTestKafkaBroker(t, func(c *config.Configuration) {})
+	if err := b.Declare(config.Topology{Queues: []config.Queue{{Name: "jobs"}}}); err != nil {
+		t.Fatal(err)
+	}
+	seedOffsets(t, admin, "jobs", "jobs")
+
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		if err := b.Publish(ctx, map[string]any{"n": i}, WithExchange(""), WithRoutingKey("jobs")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	type handled struct {
+		n      int
+		settle chan Acknowledgement
+	}
+	received := make(chan handled)
+	wg := startKafkaConsumer(t, b, DeliveryHandler(func(_ context.Context, d amqp091.Delivery) Acknowledgement {
+		h := handled{settle: make(chan Acknowledgement)}
+		var body struct {
+			N int `json:"n"`
+		}
+		if err := json.Unmarshal(d.Body, &body); err != nil {
+			t.Error(err)
+			return Drop
+		}
+		h.n = body.N
+		received <- h
+		return <-h.settle
+	}), WithQueue("jobs"), WithAutoAck(false))
+
+	first := receiveWithin(t, received, 10*time.Second)
+	if committed := committedOffset(t, admin, "jobs", "jobs"); committed != 0 {
+		t.Fatalf("offset %d committed before the first message was settled", committed)
+	}
+	first.settle <- Ack
+
+	second := receiveWithin(t, received, 10*time.Second)
+	second.settle <- Drop
+
+	// The third message is delivered once the second was rejected, and is
+	// left unsettled while the consumer stops
+	third := receiveWithin(t, received, 10*time.Second)
+	if first.n != 0 || second.n != 1 || third.n != 2 {
+		t.Fatalf("received %v, %v, %v in that order", first.n, second.n, third.n)
+	}
+	b.Shutdown()
+	awaitCommittedOffset(t, admin, "jobs", "jobs", 2)
+
+	third.settle <- Ack
+	wg.Wait()
+	if committed := committedOffset(t, admin, "jobs", "jobs"); committed != 2 {
+		t.Errorf("committed offset %d after stopping, want 2", committed)
+	}
+}
+
+func TestKafkaBrokerRetry(t *testing.T) {
+	b, admin := newTestKafkaBroker(t, func(c *config.Configuration) {
+		c.RabbitMQ.Retry.MaxAttempts = 2
+		c.RabbitMQ.Retry.Tiers = []int{1}
+	})
+	if err := b.Declare(config.Topology{Queues: []config.Queue{{Name: "jobs"}}}); err != nil {
+		t.Fatal(err)
+	}
+	seedOffsets(t, admin, "jobs", "jobs")
+
+	if err := b.Publish(context.Background(), map[string]any{}, WithExchange(""), WithRoutingKey("jobs")); err != nil {
+		t.Fatal(err)
+	}
+
+	deliveries := make(chan amqp091.Delivery, 4)
+	wg := startKafkaConsumer(t, b, DeliveryHandler(func(_ context.Context, d amqp091.Delivery) Acknowledgement {
+		deliveries <- d
+		if DeliveryAttempts(d) == 0 {
+			return Retry
+		}
+		return Ack
+	}), WithQueue("jobs"), WithAutoAck(false))
+
+	first := receiveWithin(t, deliveries, 10*time.Second)
+	if first.Redelivered || DeliveryAttempts(first) != 0 {
+		t.Fatalf("first delivery redelivered %t with %d attempts", first.Redelivered, DeliveryAttempts(first))
+	}
+	start := time.Now()
+	second := receiveWithin(t, deliveries, 5*time.Second)
+	if !second.Redelivered || DeliveryAttempts(second) != 1 {
+		t.Fatalf("retried delivery redelivered %t with %d attempts", second.Redelivered, DeliveryAttempts(second))
+	}
+	if elapsed := time.Since(start); elapsed < 900*time.Millisecond {
+		t.Fatalf("retried after %s, before the 1s tier", elapsed)
+	}
+	if second.DeliveryTag != first.DeliveryTag {
+		t.Errorf("retry changed the delivery tag from %d to %d", first.DeliveryTag, second.DeliveryTag)
+	}
+	receiveNone(t, deliveries, 200*time.Millisecond)
+
+	b.Shutdown()
+	wg.Wait()
+	if committed := committedOffset(t, admin, "jobs", "jobs"); committed != 1 {
+		t.Errorf("committed offset %d after the retried message was acked, want 1", committed)
+	}
+}
+
+func TestKafkaBrokerDeletesGeneratedGroup(t *testing.T) {
+	b, admin := newTestKafkaBroker(t, func(c *config.Configuration) {})
+
+	received := make(chan amqp091.Delivery, 100)
+	wg := startKafkaConsumer(t, b, DeliveryHandler(func(_ context.Context, d amqp091.Delivery) Acknowledgement {
+		received <- d
+		return Ack
+	}))
+
+	// A generated queue starts at the end of the topic, so publish until the
+	// consumer has joined and picks one up
+	ctx := context.Background()
+	deadline := time.Now().Add(15 * time.Second)
+	for delivered := false; !delivered; {
+		if time.Now().After(deadline) {
+			t.Fatal("the consumer of a generated queue received nothing")
+		}
+		if err := b.Publish(ctx, map[string]any{}); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case d := <-received:
+			delivered = true
+			if d.Exchange != testExchange {
+				t.Errorf("received from exchange %q, want %q", d.Exchange, testExchange)
+			}
+		case <-time.After(200 * time.Millisecond):
+		}
+	}
+
+	groups := func() []string {
+		listCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		listed, err := admin.ListGroups(listCtx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var generated []string
+		for _, group := range listed.Groups() {
+			if strings.HasPrefix(group, "amq.gen-") {
+				generated = append(generated, group)
+			}
+		}
+		return generated
+	}
+	if generated := groups(); len(generated) != 1 {
+		t.Fatalf("generated consumer groups %v, want one", generated)
+	}
+
+	b.Shutdown()
+	wg.Wait()
+	if generated := groups(); len(generated) != 0 {
+		t.Errorf("generated consumer groups %v left after the consumer stopped", generated)
+	}
+}
+
+func TestKafkaBrokerRebalancesWhileHandling(t *testing.T) {
+	b, _ := newTestKafkaBroker(t, func(c *config.Configuration) {
+		c.Broker.Kafka.Partitions = 2
+	})
+	err := b.Declare(config.Topology{
+		Exchanges: []config.Exchange{{Name: "events", Type: amqp091.ExchangeTopic}},
+		Queues:    []config.Queue{{Name: "jobs"}},
+		Bindings:  []config.Binding{{Exchange: "events", Queue: "jobs", RoutingKeys: []string{"#"}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The first consumer is stuck handling its first message
+	release := make(chan struct{})
+	first := make(chan amqp091.Delivery, 100)
+	startKafkaConsumer(t, b, DeliveryHandler(func(_ context.Context, d amqp091.Delivery) Acknowledgement {
+		first <- d
+		<-release
+		return Ack
+	}), WithQueue("jobs"), WithAutoAck(false))
+	t.Cleanup(func() { close(release) })
+
+	// Both consumers start at the end of the topic, so publish until they
+	// have joined and pick a message up
+	ctx := context.Background()
+	n := 0
+	publishUntil := func(received chan amqp091.Delivery, who string) {
+		t.Helper()
+		deadline := time.Now().Add(15 * time.Second)
+		for {
+			if time.Now().After(deadline) {
+				t.Fatalf("the %s consumer received nothing", who)
+			}
+			n++
+			if err := b.Publish(ctx, map[string]any{}, WithExchange("events"), WithRoutingKey(fmt.Sprintf("key.%d", n))); err != nil {
+				t.Fatal(err)
+			}
+			select {
+			case <-received:
+				return
+			case <-time.After(200 * time.Millisecond):
+			}
+		}
+	}
+	publishUntil(first, "first")
+
+	second := make(chan amqp091.Delivery, 100)
+	startKafkaConsumer(t, b, DeliveryHandler(func(_ context.Context, d amqp091.Delivery) Acknowledgement {
+		second <- d
+		return Ack
+	}), WithQueue("jobs"), WithAutoAck(false))
+	publishUntil(second, "second")
+}
@@ -0,0 +1,76 @@
+package messagebrokers
+
+import (
+	"github.com/Roh-Bot/rabbitmq-pub-sub/internal/config"
+	"github.com/Roh-Bot/rabbitmq-pub-sub/pkg/loggers"
+	"go.uber.org/zap"
+	"os"
+	"testing"
+	"time"
+)
+
+const testExchange = "Publisher"
+
+func TestMain(m *testing.M) {
+	loggers.Zap.SugaredLogger = zap.NewNop().Sugar()
+	config.SetConfig(testConfig())
+	os.Exit(m.Run())
+}
+
+// testConfig is the configuration every test starts from: a fanout exchange
+// named Publisher and no retries.
+func testConfig() *config.Configuration {
+	c := new(config.Configuration)
+	c.RabbitMQ.Host = "127.0.0.1"
+	c.RabbitMQ.Port = 5672
+	c.RabbitMQ.User = "guest"
+	c.RabbitMQ.Password = "guest"
+	c.RabbitMQ.Exchange = testExchange
+	c.RabbitMQ.AppId = "messagebrokers-test"
+	c.RabbitMQ.Topology.Exchanges = []config.Exchange{{Name: testExchange, Type: "fanout"}}
+	c.Backoff.InitialInterval = 1
+	c.Backoff.MaxInterval = 1
+	c.Backoff.Mulltiplier = 1
+	return c
+}
+
+// setConfig applies modify to a fresh testConfig for the rest of the test.
+// Tests calling it must not run in parallel.
+func setConfig(t testing.TB, modify func(c *config.Configuration)) {
+	t.Helper()
+	c := testConfig()
+	modify(c)
+	config.SetConfig(c)
+	t.Cleanup(func() {
+		config.SetConfig(testConfig())
+	})
+}
+
+// receiveWithin returns the next value of c, failing the test if none
+// arrives within timeout.
+func receiveWithin[T any](t testing.TB, c <-chan T, timeout time.Duration) T {
+	t.Helper()
+	select {
+	case v, ok := <-c:
+		if !ok {
+			t.Fatal("channel closed")
+		}
+		return v
+	case <-time.After(timeout):
+		t.Fatalf("nothing received within %s", timeout)
+	}
+	var zero T
+	return zero
+}
+
+// receiveNone fails the test if c yields a value within timeout.
+func receiveNone[T any](t testing.TB, c <-chan T, timeout time.Duration) {
+	t.Helper()
+	select {
+	case v, ok := <-c:
+		if ok {
+			t.Fatalf("unexpectedly received %v", v)
+		}
+	case <-time.After(timeout):
+	}
+}
@@ -0,0 +1,618 @@
+package messagebrokers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/Roh-Bot/rabbitmq-pub-sub/internal/config"
+	"github.com/Roh-Bot/rabbitmq-pub-sub/pkg/global"
+	"github.com/Roh-Bot/rabbitmq-pub-sub/pkg/loggers"
+	"github.com/rabbitmq/amqp091-go"
+	"log"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrUnknownExchange     = errors.New("exchange not found")
+	ErrUnknownQueue        = errors.New("queue not found")
+	ErrUnknownDeliveryTag  = errors.New("unknown delivery tag")
+	ErrExchangeTypeChanged = errors.New("exchange already declared with a different type")
+)
+
+// MemoryBroker is an in-process MessageBroker with fanout, direct and topic
+// exchanges, acknowledgements and redelivery. Unacked messages are requeued
+// when their consumer stops, and Retry goes through the configured retry
+// tiers. Nothing is persisted.
+type MemoryBroker struct {
+	p *Publisher[map[string]any]
+
+	mutex     *sync.Mutex
+	exchanges map[string]*memoryExchange
+	queues    map[string]*memoryQueue
+	closed    bool
+	consumers atomic.Uint64
+}
+
+type memoryExchange struct {
+	kind     string
+	bindings []memoryBinding
+}
+
+type memoryBinding struct {
+	queue      string
+	routingKey string
+}
+
+// exchangeRoutes reports whether a binding with bindingKey to an exchange of
+// kind receives a message published with key.
+func exchangeRoutes(kind, bindingKey, key string) bool {
+	switch kind {
+	case amqp091.ExchangeFanout:
+		return true
+	case amqp091.ExchangeTopic:
+		return matchTopic(bindingKey, key)
+	default:
+		return bindingKey == key
+	}
+}
+
+// NewMemoryBroker creates a broker with the configured topology declared.
+func NewMemoryBroker() (*MemoryBroker, error) {
+	m := &MemoryBroker{
+		p:         NewPublisher(publisherOptions()...),
+		mutex:     new(sync.Mutex),
+		exchanges: make(map[string]*memoryExchange),
+		queues:    make(map[string]*memoryQueue),
+	}
+	if err := m.Declare(config.GetConfig().RabbitMQ.Topology); err != nil {
+		return nil, err
+	}
+	log.Println("Started in-memory message broker")
+	return m, nil
+}
+
+func (m *MemoryBroker) Publisher() *Publisher[map[string]any] {
+	return m.p
+}
+
+// Declare declares exchanges, queues and bindings. Exchanges may be fanout,
+// direct or topic; re-declaring an exchange with another type fails.
+func (m *MemoryBroker) Declare(topology config.Topology) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for _, e := range topology.Exchanges {
+		if err := m.declareExchangeLocked(e.Name, e.Type); err != nil {
+			return err
+		}
+	}
+	for _, q := range topology.Queues {
+		m.declareQueueLocked(q.Name)
+	}
+	for _, b := range topology.Bindings {
+		keys := b.RoutingKeys
+		if len(keys) == 0 {
+			keys = []string{""}
+		}
+		for _, key := range keys {
+			if err := m.bindLocked(b.Queue, b.Exchange, key); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (m *MemoryBroker) declareExchangeLocked(name, kind string) error {
+	if kind == "" {
+		kind = amqp091.ExchangeFanout
+	}
+	switch kind {
+	case amqp091.ExchangeFanout, amqp091.ExchangeDirect, amqp091.ExchangeTopic:
+	default:
+		return fmt.Errorf("declaring exchange %s: unsupported type %q", name, kind)
+	}
+	if e, ok := m.exchanges[name]; ok {
+		if e.kind != kind {
+			return fmt.Errorf("declaring exchange %s: %w", name, ErrExchangeTypeChanged)
+		}
+		return nil
+	}
+	m.exchanges[name] = &memoryExchange{kind: kind}
+	return nil
+}
+
+func (m *MemoryBroker) declareQueueLocked(name string) *memoryQueue {
+	if q, ok := m.queues[name]; ok {
+		return q
+	}
+	q := newMemoryQueue(name, m.deadLetter)
+	m.queues[name] = q
+	return q
+}
+
+func (m *MemoryBroker) bindLocked(queue, exchange, key string) error {
+	e, ok := m.exchanges[exchange]
+	if !ok {
+		return fmt.Errorf("binding queue %s: %w: %s", queue, ErrUnknownExchange, exchange)
+	}
+	if _, ok := m.queues[queue]; !ok {
+		return fmt.Errorf("binding queue %s to %s: %w", queue, exchange, ErrUnknownQueue)
+	}
+	for _, b := range e.bindings {
+		if b.queue == queue && b.routingKey == key {
+			return nil
+		}
+	}
+	e.bindings = append(e.bindings, memoryBinding{queue: queue, routingKey: key})
+	return nil
+}
+
+// deleteQueue removes the queue and its bindings.
+func (m *MemoryBroker) deleteQueue(name string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if q, ok := m.queues[name]; ok {
+		q.close()
+		delete(m.queues, name)
+	}
+	for _, e := range m.exchanges {
+		bindings := e.bindings[:0]
+		for _, b := range e.bindings {
+			if b.queue != name {
+				bindings = append(bindings, b)
+			}
+		}
+		e.bindings = bindings
+	}
+}
+
+// Publish encodes body like RabbitMq.Publish and routes it to every bound
+// queue. Messages that match no queue are discarded.
+func (m *MemoryBroker) Publish(ctx context.Context, body any, opts ...PublishOption) error {
+	o, msg, err := preparePublishing(ctx, body, opts)
+	if err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return &PublishError{Exchange: o.exchange, Err: err}
+	}
+	if err := m.route(o.exchange, o.routingKey, msg); err != nil {
+		return &PublishError{Exchange: o.exchange, Err: err}
+	}
+	return nil
+}
+
+func (m *MemoryBroker) route(exchange, key string, msg amqp091.Publishing) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.closed {
+		return ErrConnectionClosed
+	}
+
+	targets := make([]*memoryQueue, 0)
+	if exchange == "" {
+		// The default exchange routes to the queue named by the routing key
+		if q, ok := m.queues[key]; ok {
+			targets = append(targets, q)
+		}
+	} else {
+		e, ok := m.exchanges[exchange]
+		if !ok {
+			return fmt.Errorf("%w: %s", ErrUnknownExchange, exchange)
+		}
+		seen := make(map[string]bool)
+		for _, b := range e.bindings {
+			if seen[b.queue] || !exchangeRoutes(e.kind, b.routingKey, key) {
+				continue
+			}
+			seen[b.queue] = true
+			targets = append(targets, m.queues[b.queue])
+		}
+	}
+
+	for _, q := range targets {
+		q.enqueue(amqp091.Delivery{
+			Headers:         copyTable(msg.Headers),
+			ContentType:     msg.ContentType,
+			ContentEncoding: msg.ContentEncoding,
+			DeliveryMode:    msg.DeliveryMode,
+			Priority:        msg.Priority,
+			CorrelationId:   msg.CorrelationId,
+			ReplyTo:         msg.ReplyTo,
+			Expiration:      msg.Expiration,
+			MessageId:       msg.MessageId,
+			Timestamp:       msg.Timestamp,
+			Type:            msg.Type,
+			UserId:          msg.UserId,
+			AppId:           msg.AppId,
+			Exchange:        exchange,
+			RoutingKey:      key,
+			Body:            msg.Body,
+		})
+	}
+	return nil
+}
+
+// Consume follows RabbitMq.Consume: without WithQueue the consumer gets a
+// queue of its own, bound to the configured exchange unless WithBindings is
+// given, which is deleted when the consumer stops.
+func (m *MemoryBroker) Consume(wg *sync.WaitGroup, handler Handler, opts ...ConsumerOption) {
+	defer wg.Done()
+
+	o := newConsumerOptions(opts)
+	handler = Chain(handler, o.middlewares...)
+
+	named := o.queue != ""
+	queueName := o.queue
+	if !named {
+		queueName = "amq.gen-" + NewMessageId()
+		defer m.deleteQueue(queueName)
+	}
+
+	q, err := m.consumerQueue(queueName, named, o.bindings)
+	if err != nil {
+		loggers.Zap.Errorf("Memory broker error: %s", err.Error())
+		return
+	}
+
+	consumer := fmt.Sprintf("ctag-%d", m.consumers.Add(1))
+	ctx, cancel := context.WithCancel(global.CancellationContext())
+	defer func() {
+		cancel()
+		q.cancel(consumer)
+	}()
+
+	log.Printf(" [*] Waiting for messages from queue: %s. To exit press CTRL+C", queueName)
+	receive(queueName, q.consume(ctx, consumer, o.autoAck, o.prefetchCount), handler, o, m.retry)
+	log.Printf("Memory receiver for queue %s stopped", queueName)
+}
+
+func (m *MemoryBroker) consumerQueue(queueName string, named bool, bindings []Binding) (*memoryQueue, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.closed {
+		return nil, ErrConnectionClosed
+	}
+
+	q := m.declareQueueLocked(queueName)
+	if len(bindings) == 0 && !named {
+		bindings = []Binding{{Exchange: config.GetConfig().RabbitMQ.Exchange}}
+	}
+	for _, b := range bindings {
+		exchange := b.Exchange
+		if exchange == "" {
+			exchange = config.GetConfig().RabbitMQ.Exchange
+		}
+		if err := m.bindLocked(queueName, exchange, b.RoutingKey); err != nil {
+			return nil, err
+		}
+	}
+	return q, nil
+}
+
+// retry acks the delivery and requeues a copy once the retry tier's delay has
+// passed, recording the attempt in x-death like the RabbitMQ retry queues.
+// Deliveries that have exhausted their attempts are dead-lettered.
+func (m *MemoryBroker) retry(_ context.Context, queueName string, deliver amqp091.Delivery) error {
+	if !retryEnabled() {
+		return deliver.Nack(false, true)
+	}
+
+	tier, ok := nextRetryTier(deliver)
+	if !ok {
+		return deliver.Reject(false)
+	}
+
+	retried := deliver
+	retried.Headers = recordDeath(deliver.Headers, retryTierName(tier), queueName)
+	retried.Redelivered = false
+	if err := deliver.Ack(false); err != nil {
+		return err
+	}
+
+	time.AfterFunc(tier, func() {
+		m.mutex.Lock()
+		defer m.mutex.Unlock()
+		if q, ok := m.queues[queueName]; ok && !m.closed {
+			q.enqueue(retried)
+		}
+	})
+	return nil
+}
+
+// deadLetter moves rejected deliveries to the parking-lot queue when retries
+// are enabled and discards them otherwise, as RabbitMQ does.
+func (m *MemoryBroker) deadLetter(deliver amqp091.Delivery) {
+	if !retryEnabled() {
+		return
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.closed {
+		return
+	}
+	m.declareQueueLocked(parkingLotQueue()).enqueue(deliver)
+}
+
+// Shutdown closes every queue, which stops all consumers, and the Publisher.
+func (m *MemoryBroker) Shutdown() {
+	log.Println("Closing in-memory message broker...")
+	m.mutex.Lock()
+	if m.closed {
+		m.mutex.Unlock()
+		return
+	}
+	m.closed = true
+	queues := make([]*memoryQueue, 0, len(m.queues))
+	for _, q := range m.queues {
+		queues = append(queues, q)
+	}
+	m.mutex.Unlock()
+
+	for _, q := range queues {
+		q.close()
+	}
+	m.p.Shutdown()
+	log.Println("In-memory message broker closed")
+}
+
+// memoryQueue holds ready and unacked deliveries and settles them as the
+// Acknowledger of every delivery it hands out.
+type memoryQueue struct {
+	name       string
+	deadLetter func(amqp091.Delivery)
+
+	mutex   *sync.Mutex
+	ready   []amqp091.Delivery
+	unacked map[uint64]amqp091.Delivery
+	nextTag uint64
+	closed  bool
+	// changed is closed and replaced whenever a delivery becomes ready or is settled
+	changed chan struct{}
+}
+
+func newMemoryQueue(name string, deadLetter func(amqp091.Delivery)) *memoryQueue {
+	return &memoryQueue{
+		name:       name,
+		deadLetter: deadLetter,
+		mutex:      new(sync.Mutex),
+		unacked:    make(map[uint64]amqp091.Delivery),
+		changed:    make(chan struct{}),
+	}
+}
+
+// notifyLocked must be called with q.mutex held.
+func (q *memoryQueue) notifyLocked() {
+	close(q.changed)
+	q.changed = make(chan struct{})
+}
+
+func (q *memoryQueue) enqueue(deliver amqp091.Delivery) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.closed {
+		return
+	}
+	q.ready = append(q.ready, deliver)
+	q.notifyLocked()
+}
+
+// consume hands deliveries to the returned channel until ctx is cancelled or
+// the queue is closed. Without auto-ack at most prefetch deliveries are
+// outstanding at a time when prefetch is positive.
+func (q *memoryQueue) consume(ctx context.Context, consumer string, autoAck bool, prefetch int) <-chan amqp091.Delivery {
+	msgs := make(chan amqp091.Delivery)
+	go func() {
+		defer close(msgs)
+		for {
+			deliver, ok := q.next(ctx, consumer, autoAck, prefetch)
+			if !ok {
+				return
+			}
+			select {
+			case msgs <- deliver:
+			case <-ctx.Done():
+				if !autoAck {
+					_ = q.Nack(deliver.DeliveryTag, false, true)
+				}
+				return
+			}
+		}
+	}()
+	return msgs
+}
+
+func (q *memoryQueue) next(ctx context.Context, consumer string, autoAck bool, prefetch int) (amqp091.Delivery, bool) {
+	for {
+		q.mutex.Lock()
+		if q.closed {
+			q.mutex.Unlock()
+			return amqp091.Delivery{}, false
+		}
+		if len(q.ready) != 0 && (autoAck || prefetch <= 0 || q.inFlightLocked(consumer) < prefetch) {
+			deliver := q.ready[0]
+			q.ready = q.ready[1:]
+			q.nextTag++
+			deliver.DeliveryTag = q.nextTag
+			deliver.ConsumerTag = consumer
+			deliver.Acknowledger = q
+			if !autoAck {
+				q.unacked[deliver.DeliveryTag] = deliver
+			}
+			q.mutex.Unlock()
+			return deliver, true
+		}
+		changed := q.changed
+		q.mutex.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return amqp091.Delivery{}, false
+		case <-changed:
+		}
+	}
+}
+
+func (q *memoryQueue) inFlightLocked(consumer string) int {
+	n := 0
+	for _, d := range q.unacked {
+		if d.ConsumerTag == consumer {
+			n++
+		}
+	}
+	return n
+}
+
+// takeLocked removes tag, or with multiple every tag up to it, from the
+// unacked deliveries and returns them in delivery order.
+func (q *memoryQueue) takeLocked(tag uint64, multiple bool) ([]amqp091.Delivery, error) {
+	if !multiple {
+		d, ok := q.unacked[tag]
+		if !ok {
+			return nil, ErrUnknownDeliveryTag
+		}
+		delete(q.unacked, tag)
+		return []amqp091.Delivery{d}, nil
+	}
+
+	taken := make([]amqp091.Delivery, 0)
+	for t, d := range q.unacked {
+		if t <= tag {
+			taken = append(taken, d)
+			delete(q.unacked, t)
+		}
+	}
+	sort.Slice(taken, func(i, j int) bool {
+		return taken[i].DeliveryTag < taken[j].DeliveryTag
+	})
+	return taken, nil
+}
+
+// requeueLocked puts deliveries back at the head of the queue, marked as redelivered.
+func (q *memoryQueue) requeueLocked(deliveries []amqp091.Delivery) {
+	requeued := make([]amqp091.Delivery, 0, len(deliveries)+len(q.ready))
+	for _, d := range deliveries {
+		d.Redelivered = true
+		d.DeliveryTag, d.ConsumerTag, d.Acknowledger = 0, "", nil
+		requeued = append(requeued, d)
+	}
+	q.ready = append(requeued, q.ready...)
+}
+
+func (q *memoryQueue) Ack(tag uint64, multiple bool) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if _, err := q.takeLocked(tag, multiple); err != nil {
+		return err
+	}
+	q.notifyLocked()
+	return nil
+}
+
+func (q *memoryQueue) Nack(tag uint64, multiple bool, requeue bool) error {
+	q.mutex.Lock()
+	taken, err := q.takeLocked(tag, multiple)
+	if err != nil {
+		q.mutex.Unlock()
+		return err
+	}
+	if requeue {
+		q.requeueLocked(taken)
+	}
+	q.notifyLocked()
+	q.mutex.Unlock()
+
+	if !requeue {
+		for _, d := range taken {
+			d.DeliveryTag, d.ConsumerTag, d.Acknowledger = 0, "", nil
+			q.deadLetter(d)
+		}
+	}
+	return nil
+}
+
+func (q *memoryQueue) Reject(tag uint64, requeue bool) error {
+	return q.Nack(tag, false, requeue)
+}
+
+// cancel requeues the deliveries consumer has not settled, as closing a
+// RabbitMQ channel does.
+func (q *memoryQueue) cancel(consumer string) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	pending := make([]amqp091.Delivery, 0)
+	for tag, d := range q.unacked {
+		if d.ConsumerTag == consumer {
+			pending = append(pending, d)
+			delete(q.unacked, tag)
+		}
+	}
+	if len(pending) == 0 {
+		return
+	}
+	sort.Slice(pending, func(i, j int) bool {
+		return pending[i].DeliveryTag < pending[j].DeliveryTag
+	})
+	q.requeueLocked(pending)
+	q.notifyLocked()
+}
+
+func (q *memoryQueue) close() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.closed {
+		return
+	}
+	q.closed = true
+	q.notifyLocked()
+}
+
+func copyTable(table amqp091.Table) amqp091.Table {
+	if table == nil {
+		return nil
+	}
+	c := make(amqp091.Table, len(table))
+	for k, v := range table {
+		c[k] = v
+	}
+	return c
+}
+
+// recordDeath returns a copy of headers with the x-death entry for queue
+// counted up, in the format RabbitMQ uses for dead-lettered messages.
+func recordDeath(headers amqp091.Table, queue, routingKey string) amqp091.Table {
+	headers = copyTable(headers)
+	if headers == nil {
+		headers = amqp091.Table{}
+	}
+
+	deaths, _ := headers["x-death"].([]interface{})
+	updated := make([]interface{}, 0, len(deaths)+1)
+	found := false
+	for _, d := range deaths {
+		if death, ok := d.(amqp091.Table); ok && death["queue"] == queue {
+			death = copyTable(death)
+			count, _ := death["count"].(int64)
+			death["count"] = count + 1
+			found = true
+			d = death
+		}
+		updated = append(updated, d)
+	}
+	if !found {
+		updated = append(updated, amqp091.Table{
+			"queue":        queue,
+			"reason":       "expired",
+			"count":        int64(1),
+			"routing-keys": []interface{}{routingKey},
+		})
+	}
+	headers["x-death"] = updated
+	return headers
+}
@@ -0,0 +1,369 @@
+package messagebrokers
+
+import (
+	"context"
+	"errors"
+	"github.com/Roh-Bot/rabbitmq-pub-sub/internal/config"
+	"github.com/rabbitmq/amqp091-go"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestMemoryBroker(t *testing.T) *MemoryBroker {
+	t.Helper()
+	m, err := NewMemoryBroker()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(m.Shutdown)
+	return m
+}
+
+// readyCounts returns the number of ready deliveries of every queue.
+func readyCounts(m *MemoryBroker) map[string]int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	counts := make(map[string]int, len(m.queues))
+	for name, q := range m.queues {
+		q.mutex.Lock()
+		counts[name] = len(q.ready)
+		q.mutex.Unlock()
+	}
+	return counts
+}
+
+func memoryQueueOf(t *testing.T, m *MemoryBroker, name string) *memoryQueue {
+	t.Helper()
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	q, ok := m.queues[name]
+	if !ok {
+		t.Fatalf("queue %s not declared", name)
+	}
+	return q
+}
+
+func TestMemoryBrokerRouting(t *testing.T) {
+	m := newTestMemoryBroker(t)
+	err := m.Declare(config.Topology{
+		Exchanges: []config.Exchange{
+			{Name: "fan", Type: amqp091.ExchangeFanout},
+			{Name: "direct", Type: amqp091.ExchangeDirect},
+			{Name: "topic", Type: amqp091.ExchangeTopic},
+		},
+		Queues: []config.Queue{
+			{Name: "fan-a"}, {Name: "fan-b"}, {Name: "direct-a"}, {Name: "direct-b"},
+			{Name: "topic-orders"}, {Name: "topic-audit"},
+		},
+		Bindings: []config.Binding{
+			{Exchange: "fan", Queue: "fan-a"},
+			{Exchange: "fan", Queue: "fan-b"},
+			{Exchange: "direct", Queue: "direct-a", RoutingKeys: []string{"a"}},
+			{Exchange: "direct", Queue: "direct-b", RoutingKeys: []string{"b"}},
+			{Exchange: "topic", Queue: "topic-orders", RoutingKeys: []string{"orders.*.created"}},
+			{Exchange: "topic", Queue: "topic-audit", RoutingKeys: []string{"audit.#"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		exchange string
+		key      string
+		want     []string
+	}{
+		{"fanout ignores the key", "fan", "anything", []string{"fan-a", "fan-b"}},
+		{"direct matches the key", "direct", "a", []string{"direct-a"}},
+		{"direct without match", "direct", "c", nil},
+		{"topic single word wildcard", "topic", "orders.eu.created", []string{"topic-orders"}},
+		{"topic wildcard needs a word", "topic", "orders.created", nil},
+		{"topic other verb", "topic", "orders.eu.deleted", nil},
+		{"topic hash matches no words", "topic", "audit", []string{"topic-audit"}},
+		{"topic hash matches many words", "topic", "audit.orders.eu", []string{"topic-audit"}},
+		{"default exchange routes by queue name", "", "direct-b", []string{"direct-b"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := readyCounts(m)
+			err := m.Publish(context.Background(), map[string]any{"n": 1},
+				WithExchange(tt.exchange), WithRoutingKey(tt.key))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got []string
+			for name, n := range readyCounts(m) {
+				if n > before[name] {
+					got = append(got, name)
+				}
+			}
+			sort.Strings(got)
+			if len(got) != len(tt.want) {
+				t.Fatalf("routed to %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("routed to %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestMemoryBrokerPublishUnknownExchange(t *testing.T) {
+	m := newTestMemoryBroker(t)
+	err := m.Publish(context.Background(), map[string]any{}, WithExchange("missing"))
+	if !errors.Is(err, ErrUnknownExchange) {
+		t.Fatalf("got %v, want ErrUnknownExchange", err)
+	}
+	var publishErr *PublishError
+	if !errors.As(err, &publishErr) || publishErr.Exchange != "missing" {
+		t.Fatalf("got %v, want a PublishError for exchange missing", err)
+	}
+}
+
+func TestMemoryBrokerDeclareTypeChange(t *testing.T) {
+	m := newTestMemoryBroker(t)
+	err := m.Declare(config.Topology{Exchanges: []config.Exchange{{Name: testExchange, Type: amqp091.ExchangeTopic}}})
+	if !errors.Is(err, ErrExchangeTypeChanged) {
+		t.Fatalf("got %v, want ErrExchangeTypeChanged", err)
+	}
+}
+
+func TestMemoryQueueAck(t *testing.T) {
+	q := newMemoryQueue("q", func(amqp091.Delivery) {})
+	q.enqueue(amqp091.Delivery{MessageId: "1"})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	d := receiveWithin(t, q.consume(ctx, "c1", false, 0), time.Second)
+
+	if err := d.Ack(false); err != nil {
+		t.Fatal(err)
+	}
+	q.mutex.Lock()
+	ready, unacked := len(q.ready), len(q.unacked)
+	q.mutex.Unlock()
+	if ready != 0 || unacked != 0 {
+		t.Fatalf("queue not empty after ack: %d ready, %d unacked", ready, unacked)
+	}
+	if err := d.Ack(false); !errors.Is(err, ErrUnknownDeliveryTag) {
+		t.Fatalf("second ack: got %v, want ErrUnknownDeliveryTag", err)
+	}
+}
+
+func TestMemoryQueueNackRequeue(t *testing.T) {
+	q := newMemoryQueue("q", func(amqp091.Delivery) {})
+	q.enqueue(amqp091.Delivery{MessageId: "1"})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	msgs := q.consume(ctx, "c1", false, 0)
+
+	d := receiveWithin(t, msgs, time.Second)
+	if d.Redelivered {
+		t.Fatal("first delivery marked as redelivered")
+	}
+	if err := d.Nack(false, true); err != nil {
+		t.Fatal(err)
+	}
+
+	d = receiveWithin(t, msgs, time.Second)
+	if d.MessageId != "1" || !d.Redelivered {
+		t.Fatalf("got message %s redelivered=%t, want message 1 redelivered", d.MessageId, d.Redelivered)
+	}
+}
+
+func TestMemoryBrokerRejectParksMessage(t *testing.T) {
+	setConfig(t, func(c *config.Configuration) {
+		c.RabbitMQ.Retry.MaxAttempts = 3
+	})
+	m := newTestMemoryBroker(t)
+	if err := m.Declare(config.Topology{Queues: []config.Queue{{Name: "jobs"}}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Publish(context.Background(), map[string]any{}, WithExchange(""), WithRoutingKey("jobs")); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	d := receiveWithin(t, memoryQueueOf(t, m, "jobs").consume(ctx, "c1", false, 0), time.Second)
+	if err := d.Reject(false); err != nil {
+		t.Fatal(err)
+	}
+
+	counts := readyCounts(m)
+	if counts[parkingLotQueue()] != 1 {
+		t.Fatalf("parking lot holds %d messages, want 1", counts[parkingLotQueue()])
+	}
+	if counts["jobs"] != 0 {
+		t.Fatalf("jobs still holds %d messages", counts["jobs"])
+	}
+}
+
+func TestMemoryBrokerRejectWithoutRetryDiscards(t *testing.T) {
+	m := newTestMemoryBroker(t)
+	if err := m.Declare(config.Topology{Queues: []config.Queue{{Name: "jobs"}}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Publish(context.Background(), map[string]any{}, WithExchange(""), WithRoutingKey("jobs")); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	d := receiveWithin(t, memoryQueueOf(t, m, "jobs").consume(ctx, "c1", false, 0), time.Second)
+	if err := d.Reject(false); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := readyCounts(m)[parkingLotQueue()]; ok {
+		t.Fatal("parking lot declared without retries")
+	}
+}
+
+func TestMemoryQueueCancelRequeuesUnacked(t *testing.T) {
+	q := newMemoryQueue("q", func(amqp091.Delivery) {})
+	for _, id := range []string{"1", "2", "3"} {
+		q.enqueue(amqp091.Delivery{MessageId: id})
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	msgs := q.consume(ctx, "c1", false, 2)
+	receiveWithin(t, msgs, time.Second)
+	receiveWithin(t, msgs, time.Second)
+	cancel()
+	for range msgs {
+	}
+	q.cancel("c1")
+
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	msgs = q.consume(ctx, "c2", true, 0)
+	for _, want := range []struct {
+		id          string
+		redelivered bool
+	}{{"1", true}, {"2", true}, {"3", false}} {
+		d := receiveWithin(t, msgs, time.Second)
+		if d.MessageId != want.id || d.Redelivered != want.redelivered {
+			t.Fatalf("got message %s redelivered=%t, want %s redelivered=%t",
+				d.MessageId, d.Redelivered, want.id, want.redelivered)
+		}
+	}
+}
+
+func TestMemoryQueuePrefetch(t *testing.T) {
+	q := newMemoryQueue("q", func(amqp091.Delivery) {})
+	for _, id := range []string{"1", "2", "3"} {
+		q.enqueue(amqp091.Delivery{MessageId: id})
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	msgs := q.consume(ctx, "c1", false, 2)
+
+	first := receiveWithin(t, msgs, time.Second)
+	receiveWithin(t, msgs, time.Second)
+	receiveNone(t, msgs, 100*time.Millisecond)
+
+	if err := first.Ack(false); err != nil {
+		t.Fatal(err)
+	}
+	if d := receiveWithin(t, msgs, time.Second); d.MessageId != "3" {
+		t.Fatalf("got message %s, want 3", d.MessageId)
+	}
+}
+
+func TestMemoryBrokerConsumeRetry(t *testing.T) {
+	setConfig(t, func(c *config.Configuration) {
+		c.RabbitMQ.Retry.MaxAttempts = 2
+		c.RabbitMQ.Retry.Tiers = []int{1}
+	})
+	m := newTestMemoryBroker(t)
+	if err := m.Declare(config.Topology{Queues: []config.Queue{{Name: "jobs"}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	attempts := make(chan int, 4)
+	handler := DeliveryHandler(func(_ context.Context, d amqp091.Delivery) Acknowledgement {
+		n := DeliveryAttempts(d)
+		attempts <- n
+		if n == 0 {
+			return Retry
+		}
+		return Ack
+	})
+
+	wg := new(sync.WaitGroup)
+	wg.Add(1)
+	go m.Consume(wg, handler, WithQueue("jobs"), WithAutoAck(false))
+	t.Cleanup(func() {
+		m.Shutdown()
+		wg.Wait()
+	})
+
+	if err := m.Publish(context.Background(), map[string]any{}, WithExchange(""), WithRoutingKey("jobs")); err != nil {
+		t.Fatal(err)
+	}
+	if n := receiveWithin(t, attempts, time.Second); n != 0 {
+		t.Fatalf("first delivery has %d attempts", n)
+	}
+	start := time.Now()
+	if n := receiveWithin(t, attempts, 3*time.Second); n != 1 {
+		t.Fatalf("retried delivery has %d attempts, want 1", n)
+	}
+	if elapsed := time.Since(start); elapsed < 900*time.Millisecond {
+		t.Fatalf("retried after %s, before the 1s tier", elapsed)
+	}
+	receiveNone(t, attempts, 100*time.Millisecond)
+}
+
+func TestMemoryBrokerPublishSubscribe(t *testing.T) {
+	type order struct {
+		Id    string `json:"id"`
+		Total int    `json:"total"`
+	}
+
+	m := newTestMemoryBroker(t)
+	err := m.Declare(config.Topology{
+		Exchanges: []config.Exchange{{Name: "orders", Type: amqp091.ExchangeTopic}},
+		Queues:    []config.Queue{{Name: "billing"}},
+		Bindings:  []config.Binding{{Exchange: "orders", Queue: "billing", RoutingKeys: []string{"orders.#"}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	received := make(chan Envelope[order], 1)
+	wg := new(sync.WaitGroup)
+	wg.Add(1)
+	go Subscribe(wg, m, func(_ context.Context, msg Envelope[order]) Acknowledgement {
+		received <- msg
+		return Ack
+	}, WithQueue("billing"))
+	t.Cleanup(func() {
+		m.Shutdown()
+		wg.Wait()
+	})
+
+	err = Publish(context.Background(), m, order{Id: "o-1", Total: 42},
+		WithExchange("orders"), WithRoutingKey("orders.eu.created"), WithCorrelationId("c-1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := receiveWithin(t, received, time.Second)
+	if msg.Body != (order{Id: "o-1", Total: 42}) {
+		t.Fatalf("got body %+v", msg.Body)
+	}
+	if msg.MessageId == "" || msg.CorrelationId != "c-1" || msg.InstanceId != InstanceId() {
+		t.Fatalf("envelope not stamped: %+v", msg)
+	}
+	if msg.Delivery.RoutingKey != "orders.eu.created" || msg.Delivery.Exchange != "orders" {
+		t.Fatalf("got delivery from %s/%s", msg.Delivery.Exchange, msg.Delivery.RoutingKey)
+	}
+}
@@ -0,0 +1,197 @@
+package messagebrokers
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"github.com/Roh-Bot/rabbitmq-pub-sub/pkg/loggers"
+	"github.com/Roh-Bot/rabbitmq-pub-sub/pkg/utils"
+	"github.com/cenkalti/backoff/v4"
+	"github.com/jackc/pgx/v5"
+	"github.com/rabbitmq/amqp091-go"
+	"log"
+	"runtime/debug"
+	"sync/atomic"
+	"time"
+)
+
+// HeaderTraceParent carries the W3C trace context of a message.
+const HeaderTraceParent = "traceparent"
+
+// Handler processes a single delivery and decides how it is settled.
+type Handler interface {
+	Handle(ctx context.Context, deliver amqp091.Delivery) Acknowledgement
+}
+
+// Handle lets a DeliveryHandler be used as a Handler.
+func (h DeliveryHandler) Handle(ctx context.Context, deliver amqp091.Delivery) Acknowledgement {
+	return h(ctx, deliver)
+}
+
+// Middleware wraps a Handler with additional behaviour.
+type Middleware func(next Handler) Handler
+
+// Chain wraps h with middlewares; the first middleware is the outermost.
+func Chain(h Handler, middlewares ...Middleware) Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		h = middlewares[i](h)
+	}
+	return h
+}
+
+// DefaultMiddleware is the chain ReceiveMessages runs its handler with.
+func DefaultMiddleware() []Middleware {
+	return []Middleware{Recover(), Logging()}
+}
+
+// Recover turns a panicking handler into a Retry.
+func Recover() Middleware {
+	return func(next Handler) Handler {
+		return DeliveryHandler(func(ctx context.Context, deliver amqp091.Delivery) (ack Acknowledgement) {
+			defer func() {
+				if p := recover(); p != nil {
+					loggers.Zap.Errorf("RabbitMQ handler panicked on message %s: %v\n%s", deliver.MessageId, p, debug.Stack())
+					ack = Retry
+				}
+			}()
+			return next.Handle(ctx, deliver)
+		})
+	}
+}
+
+// Logging logs every delivery together with its outcome and handling time.
+func Logging() Middleware {
+	return func(next Handler) Handler {
+		return DeliveryHandler(func(ctx context.Context, deliver amqp091.Delivery) Acknowledgement {
+			start := time.Now()
+			ack := next.Handle(ctx, deliver)
+			log.Printf("Handled message %s from %s/%s: %s in %s",
+				deliver.MessageId, deliver.Exchange, deliver.RoutingKey, ack, time.Since(start))
+			return ack
+		})
+	}
+}
+
+// Timeout bounds the context passed to the handler. Handlers are expected to
+// honour the context; the result is not changed when they overrun.
+func Timeout(timeout time.Duration) Middleware {
+	return func(next Handler) Handler {
+		return DeliveryHandler(func(ctx context.Context, deliver amqp091.Delivery) Acknowledgement {
+			ctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			return next.Handle(ctx, deliver)
+		})
+	}
+}
+
+// ConsumerMetrics counts handled deliveries by outcome.
+type ConsumerMetrics struct {
+	Handled  atomic.Uint64
+	Acked    atomic.Uint64
+	Requeued atomic.Uint64
+	Dropped  atomic.Uint64
+	Retried  atomic.Uint64
+	// HandlingTime is the total time spent in handlers, in nanoseconds
+	HandlingTime atomic.Int64
+}
+
+// Metrics records every delivery's outcome and handling time in m.
+func Metrics(m *ConsumerMetrics) Middleware {
+	return func(next Handler) Handler {
+		return DeliveryHandler(func(ctx context.Context, deliver amqp091.Delivery) Acknowledgement {
+			start := time.Now()
+			ack := next.Handle(ctx, deliver)
+			m.HandlingTime.Add(int64(time.Since(start)))
+			m.Handled.Add(1)
+			switch ack {
+			case Ack:
+				m.Acked.Add(1)
+			case Requeue:
+				m.Requeued.Add(1)
+			case Drop:
+				m.Dropped.Add(1)
+			case Retry:
+				m.Retried.Add(1)
+			}
+			return ack
+		})
+	}
+}
+
+type traceParentKey struct{}
+
+// Tracing puts the delivery's traceparent header, or a new one if it has
+// none, into the handler's context. Messages published with that context
+// carry it on.
+func Tracing() Middleware {
+	return func(next Handler) Handler {
+		return DeliveryHandler(func(ctx context.Context, deliver amqp091.Delivery) Acknowledgement {
+			traceParent, ok := deliver.Headers[HeaderTraceParent].(string)
+			if !ok || traceParent == "" {
+				traceParent = newTraceParent()
+			}
+			return next.Handle(ContextWithTraceParent(ctx, traceParent), deliver)
+		})
+	}
+}
+
+// ContextWithTraceParent returns a context carrying traceParent.
+func ContextWithTraceParent(ctx context.Context, traceParent string) context.Context {
+	return context.WithValue(ctx, traceParentKey{}, traceParent)
+}
+
+// TraceParent returns the traceparent carried by ctx, if any.
+func TraceParent(ctx context.Context) string {
+	traceParent, _ := ctx.Value(traceParentKey{}).(string)
+	return traceParent
+}
+
+func newTraceParent() string {
+	id := make([]byte, 24)
+	_, _ = rand.Read(id)
+	return "00-" + hex.EncodeToString(id[:16]) + "-" + hex.EncodeToString(id[16:]) + "-01"
+}
+
+var errHandlerFailed = errors.New("handler asked for a retry")
+
+// Retrying re-runs the handler in process while it returns Retry or Requeue,
+// backing off according to retryOpts or the configured backoff settings.
+// The last result is returned once the retries are exhausted.
+func Retrying(retryOpts ...utils.RetryOpts) Middleware {
+	return func(next Handler) Handler {
+		return DeliveryHandler(func(ctx context.Context, deliver amqp091.Delivery) Acknowledgement {
+			var ack Acknowledgement
+			_ = utils.RetryOperation(func() error {
+				ack = next.Handle(ctx, deliver)
+				if ack != Retry && ack != Requeue {
+					return nil
+				}
+				if ctx.Err() != nil {
+					return backoff.Permanent(ctx.Err())
+				}
+				return errHandlerFailed
+			}, retryOpts...)
+			return ack
+		})
+	}
+}
+
+type txKey struct{}
+
+// TxFromContext returns the deduplication transaction the handler runs in,
+// if it was wrapped by Deduplicator.Middleware.
+func TxFromContext(ctx context.Context) (pgx.Tx, bool) {
+	tx, ok := ctx.Value(txKey{}).(pgx.Tx)
+	return tx, ok
+}
+
+// Middleware deduplicates deliveries like Handler. The transaction is
+// available to inner handlers through TxFromContext.
+func (d *Deduplicator) Middleware() Middleware {
+	return func(next Handler) Handler {
+		return d.Handler(func(ctx context.Context, tx pgx.Tx, deliver amqp091.Delivery) Acknowledgement {
+			return next.Handle(context.WithValue(ctx, txKey{}, tx), deliver)
+		})
+	}
+}
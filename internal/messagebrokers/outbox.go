@@ -0,0 +1,270 @@
+package messagebrokers
+
+import (
+	"context"
+	"errors"
+	"github.com/Roh-Bot/rabbitmq-pub-sub/internal/config"
+	"github.com/Roh-Bot/rabbitmq-pub-sub/internal/db"
+	"github.com/Roh-Bot/rabbitmq-pub-sub/internal/db/functions"
+	"github.com/Roh-Bot/rabbitmq-pub-sub/pkg/global"
+	"github.com/Roh-Bot/rabbitmq-pub-sub/pkg/loggers"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/rabbitmq/amqp091-go"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	defaultOutboxPollInterval  = 5 * time.Second
+	defaultOutboxBatchSize     = 100
+	defaultOutboxRetention     = 7 * 24 * time.Hour
+	defaultOutboxPruneInterval = time.Hour
+)
+
+// EnqueueOutbox encodes body and stores it in the outbox within tx, so the
+// message is only relayed if the caller's transaction commits. Messages that
+// share an aggregateId are published in the order they were enqueued.
+func EnqueueOutbox(ctx context.Context, tx pgx.Tx, aggregateId string, body any, opts ...PublishOption) error {
+	o, msg, err := preparePublishing(ctx, body, opts)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(ctx, functions.InsertOutboxMessage,
+		aggregateId,
+		o.exchange,
+		o.routingKey,
+		msg.MessageId,
+		msg.CorrelationId,
+		msg.Type,
+		msg.ContentType,
+		msg.ContentEncoding,
+		map[string]any(msg.Headers),
+		msg.Body,
+	)
+	if err != nil {
+		return err
+	}
+	// Delivered on commit, waking up the relays
+	_, err = tx.Exec(ctx, functions.NotifyOutbox)
+	return err
+}
+
+// OutboxRelay publishes outbox rows with confirms and marks them sent. Any
+// number of relays may run against the same table.
+type OutboxRelay struct {
+	r         *RabbitMq
+	interval  time.Duration
+	batchSize int
+	retention time.Duration
+}
+
+type outboxRow struct {
+	id              int64
+	aggregateId     string
+	exchange        string
+	routingKey      string
+	messageId       string
+	correlationId   string
+	messageType     string
+	contentType     string
+	contentEncoding string
+	headers         map[string]any
+	body            []byte
+	createdAt       time.Time
+}
+
+// NewOutboxRelay creates the outbox table if needed.
+func (r *RabbitMq) NewOutboxRelay() (*OutboxRelay, error) {
+	if err := db.Postgres().ExecNonQuery(functions.CreateOutboxTable); err != nil {
+		return nil, err
+	}
+
+	relay := &OutboxRelay{
+		r:         r,
+		interval:  time.Duration(config.GetConfig().RabbitMQ.Outbox.PollInterval) * time.Second,
+		batchSize: config.GetConfig().RabbitMQ.Outbox.BatchSize,
+		retention: time.Duration(config.GetConfig().RabbitMQ.Outbox.Retention) * time.Second,
+	}
+	if relay.interval <= 0 {
+		relay.interval = defaultOutboxPollInterval
+	}
+	if relay.batchSize <= 0 {
+		relay.batchSize = defaultOutboxBatchSize
+	}
+	if relay.retention <= 0 {
+		relay.retention = defaultOutboxRetention
+	}
+	return relay, nil
+}
+
+// Prune deletes rows sent before the retention period. Unsent rows are kept.
+func (o *OutboxRelay) Prune() error {
+	return db.Postgres().ExecNonQuery(functions.PruneOutbox, o.retention.Seconds())
+}
+
+// RunPruner prunes sent rows every rabbitmq.outbox.prune_interval seconds
+// until the global context is cancelled.
+func (o *OutboxRelay) RunPruner(wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	interval := time.Duration(config.GetConfig().RabbitMQ.Outbox.PruneInterval) * time.Second
+	if interval <= 0 {
+		interval = defaultOutboxPruneInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-global.CancellationContext().Done():
+			log.Println("Outbox pruner stopped")
+			return
+		case <-ticker.C:
+			if err := o.Prune(); err != nil {
+				loggers.Zap.Errorf("PG Error: %s", err.Error())
+			}
+		}
+	}
+}
+
+// Run relays outbox rows until the global context is cancelled. It polls
+// every rabbitmq.outbox.poll_interval seconds and wakes up early on
+// notifications from EnqueueOutbox.
+func (o *OutboxRelay) Run(wg *sync.WaitGroup) {
+	defer wg.Done()
+	ctx := global.CancellationContext()
+
+	listener := o.listen(ctx)
+	defer func() {
+		if listener != nil {
+			listener.Release()
+		}
+	}()
+
+	for {
+		for {
+			n, err := o.relayBatch(ctx)
+			if err != nil {
+				loggers.Zap.Errorf("Outbox relay error: %s", err.Error())
+				break
+			}
+			if n < o.batchSize {
+				break
+			}
+		}
+
+		if err := o.wait(ctx, listener); err != nil {
+			if ctx.Err() != nil {
+				log.Println("Outbox relay stopped")
+				return
+			}
+			loggers.Zap.Errorf("Outbox listener error: %s", err.Error())
+			if listener != nil {
+				listener.Release()
+			}
+			listener = o.listen(ctx)
+		}
+	}
+}
+
+// listen returns a connection listening for outbox notifications, or nil if
+// none could be set up, in which case the relay only polls.
+func (o *OutboxRelay) listen(ctx context.Context) *pgxpool.Conn {
+	conn, err := db.Postgres().Acquire(ctx)
+	if err != nil {
+		loggers.Zap.Errorf("PG Error: %s", err.Error())
+		return nil
+	}
+	if _, err := conn.Exec(ctx, functions.ListenOutbox); err != nil {
+		loggers.Zap.Errorf("PG Error: %s", err.Error())
+		conn.Release()
+		return nil
+	}
+	return conn
+}
+
+// wait blocks until a notification arrives or the poll interval elapses.
+func (o *OutboxRelay) wait(ctx context.Context, listener *pgxpool.Conn) error {
+	if listener == nil {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(o.interval):
+			return nil
+		}
+	}
+
+	waitCtx, cancel := context.WithTimeout(ctx, o.interval)
+	defer cancel()
+	_, err := listener.Conn().WaitForNotification(waitCtx)
+	if errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil {
+		return nil
+	}
+	return err
+}
+
+// relayBatch publishes one batch and returns the number of rows it sent.
+// Once a row of an aggregate fails, its later rows are left for the next
+// batch to preserve ordering.
+func (o *OutboxRelay) relayBatch(ctx context.Context) (int, error) {
+	tx, err := db.Postgres().Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		_ = tx.Rollback(context.Background())
+	}()
+
+	rows, err := tx.Query(ctx, functions.SelectOutboxBatch, o.batchSize)
+	if err != nil {
+		return 0, err
+	}
+	batch, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (outboxRow, error) {
+		var m outboxRow
+		err := row.Scan(&m.id, &m.aggregateId, &m.exchange, &m.routingKey, &m.messageId, &m.correlationId,
+			&m.messageType, &m.contentType, &m.contentEncoding, &m.headers, &m.body, &m.createdAt)
+		return m, err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	failed := make(map[string]bool)
+	sent := make([]int64, 0, len(batch))
+	for _, m := range batch {
+		if failed[m.aggregateId] {
+			continue
+		}
+		err := o.r.publishConfirmed(ctx, m.exchange, m.routingKey, config.GetConfig().RabbitMQ.Mandatory, amqp091.Publishing{
+			Headers:         amqp091.Table(m.headers),
+			ContentType:     m.contentType,
+			ContentEncoding: m.contentEncoding,
+			MessageId:       m.messageId,
+			CorrelationId:   m.correlationId,
+			Timestamp:       m.createdAt.UTC(),
+			Type:            m.messageType,
+			AppId:           config.GetConfig().RabbitMQ.AppId,
+			Body:            m.body,
+		})
+		if err != nil {
+			loggers.Zap.Errorf("Outbox relay failed to publish message %s: %s", m.messageId, err.Error())
+			if errors.Is(err, ErrPublishingPaused) {
+				// Do not hold the batch's locks while the broker blocks publishers
+				break
+			}
+			failed[m.aggregateId] = true
+			continue
+		}
+		sent = append(sent, m.id)
+	}
+
+	if len(sent) != 0 {
+		if _, err := tx.Exec(ctx, functions.MarkOutboxSent, sent); err != nil {
+			return 0, err
+		}
+	}
+	return len(sent), tx.Commit(ctx)
+}
@@ -0,0 +1,436 @@
+package messagebrokers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Roh-Bot/rabbitmq-pub-sub/internal/config"
+	"github.com/Roh-Bot/rabbitmq-pub-sub/internal/db"
+	"github.com/Roh-Bot/rabbitmq-pub-sub/internal/db/functions"
+	"github.com/Roh-Bot/rabbitmq-pub-sub/pkg/global"
+	"github.com/Roh-Bot/rabbitmq-pub-sub/pkg/loggers"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/rabbitmq/amqp091-go"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultPostgresPollInterval = 5 * time.Second
+	defaultPostgresBatchSize    = 100
+	defaultPostgresRetention    = 7 * 24 * time.Hour
+
+	// maxNotifyPayload keeps notifications below Postgres' 8000 byte limit.
+	// Larger messages are announced by id and read from the message table.
+	maxNotifyPayload = 7900
+)
+
+// PostgresBroker is a MessageBroker publishing over Postgres LISTEN/NOTIFY.
+// Every message is stored in rabbitmq.broker_messages, and small ones are
+// also carried in the notification itself. Consumers without WithQueue see
+// messages published while they run; consumers of a named queue resume from
+// the offset stored for it, one instance at a time. Each consumer handles
+// one message at a time, in publish order.
+type PostgresBroker struct {
+	p         *Publisher[map[string]any]
+	routes    *routingTable
+	consumers atomic.Uint64
+
+	pollInterval time.Duration
+	batchSize    int
+	retention    time.Duration
+	done         chan struct{}
+	once         sync.Once
+}
+
+// pgMessage is a stored message, also used as the notification payload.
+type pgMessage struct {
+	Id              int64          `json:"id"`
+	Exchange        string         `json:"exchange,omitempty"`
+	RoutingKey      string         `json:"routing_key,omitempty"`
+	MessageId       string         `json:"message_id,omitempty"`
+	CorrelationId   string         `json:"correlation_id,omitempty"`
+	Type            string         `json:"type,omitempty"`
+	ContentType     string         `json:"content_type,omitempty"`
+	ContentEncoding string         `json:"content_encoding,omitempty"`
+	AppId           string         `json:"app_id,omitempty"`
+	Headers         map[string]any `json:"headers,omitempty"`
+	Body            []byte         `json:"body,omitempty"`
+	CreatedAt       time.Time      `json:"created_at"`
+	// Inline is false when the message was too large to be notified
+	Inline bool `json:"inline,omitempty"`
+}
+
+func (m pgMessage) delivery() amqp091.Delivery {
+	return amqp091.Delivery{
+		Headers:         amqp091.Table(m.Headers),
+		ContentType:     m.ContentType,
+		ContentEncoding: m.ContentEncoding,
+		MessageId:       m.MessageId,
+		CorrelationId:   m.CorrelationId,
+		Timestamp:       m.CreatedAt.UTC(),
+		Type:            m.Type,
+		AppId:           m.AppId,
+		Exchange:        m.Exchange,
+		RoutingKey:      m.RoutingKey,
+		DeliveryTag:     uint64(m.Id),
+		Body:            m.Body,
+	}
+}
+
+// NewPostgresBroker creates the message and offset tables if needed and
+// starts pruning messages older than broker.postgres.retention.
+func NewPostgresBroker() (*PostgresBroker, error) {
+	if err := db.Postgres().ExecNonQuery(functions.CreateBrokerTables); err != nil {
+		return nil, err
+	}
+
+	cfg := config.GetConfig().Broker.Postgres
+	b := &PostgresBroker{
+		p:            NewPublisher(publisherOptions()...),
+		routes:       newRoutingTable(),
+		pollInterval: time.Duration(cfg.PollInterval) * time.Second,
+		batchSize:    cfg.BatchSize,
+		retention:    time.Duration(cfg.Retention) * time.Second,
+		done:         make(chan struct{}),
+	}
+	if b.pollInterval <= 0 {
+		b.pollInterval = defaultPostgresPollInterval
+	}
+	if b.batchSize <= 0 {
+		b.batchSize = defaultPostgresBatchSize
+	}
+	if b.retention <= 0 {
+		b.retention = defaultPostgresRetention
+	}
+
+	if err := b.Declare(config.GetConfig().RabbitMQ.Topology); err != nil {
+		return nil, err
+	}
+	go b.prune()
+
+	log.Println("Started Postgres message broker")
+	return b, nil
+}
+
+func (b *PostgresBroker) Publisher() *Publisher[map[string]any] {
+	return b.p
+}
+
+// Declare records exchanges and the bindings of named queues. Routing
+// happens on the consumer side, so nothing is created in Postgres.
+func (b *PostgresBroker) Declare(topology config.Topology) error {
+	return b.routes.declare(topology)
+}
+
+// Publish encodes body like RabbitMq.Publish, stores it and notifies the
+// consumers when the transaction commits.
+func (b *PostgresBroker) Publish(ctx context.Context, body any, opts ...PublishOption) error {
+	o, msg, err := preparePublishing(ctx, body, opts)
+	if err != nil {
+		return err
+	}
+	if err := b.publish(ctx, o.exchange, o.routingKey, msg); err != nil {
+		return &PublishError{Exchange: o.exchange, Err: err}
+	}
+	return nil
+}
+
+func (b *PostgresBroker) publish(ctx context.Context, exchange, key string, msg amqp091.Publishing) error {
+	select {
+	case <-b.done:
+		return ErrConnectionClosed
+	default:
+	}
+	if err := b.routes.checkExchange(exchange); err != nil {
+		return err
+	}
+
+	tx, err := db.Postgres().Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback(context.Background())
+	}()
+
+	if _, err := tx.Exec(ctx, functions.LockBrokerPublish); err != nil {
+		return err
+	}
+
+	m := pgMessage{
+		Exchange:        exchange,
+		RoutingKey:      key,
+		MessageId:       msg.MessageId,
+		CorrelationId:   msg.CorrelationId,
+		Type:            msg.Type,
+		ContentType:     msg.ContentType,
+		ContentEncoding: msg.ContentEncoding,
+		AppId:           msg.AppId,
+		Headers:         msg.Headers,
+		Body:            msg.Body,
+		Inline:          true,
+	}
+	err = tx.QueryRow(ctx, functions.InsertBrokerMessage, m.Exchange, m.RoutingKey, m.MessageId, m.CorrelationId,
+		m.Type, m.ContentType, m.ContentEncoding, m.AppId, m.Headers, m.Body).Scan(&m.Id, &m.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	payload, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	if len(payload) > maxNotifyPayload {
+		payload, err = json.Marshal(pgMessage{Id: m.Id, CreatedAt: m.CreatedAt})
+		if err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec(ctx, functions.NotifyBroker, string(payload)); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// Consume follows RabbitMq.Consume: without WithQueue the consumer only sees
+// messages of the configured exchange unless WithBindings is given. Named
+// queues also receive the bindings declared for them and messages published
+// to the default exchange with the queue name as routing key.
+func (b *PostgresBroker) Consume(wg *sync.WaitGroup, handler Handler, opts ...ConsumerOption) {
+	defer wg.Done()
+
+	o := newConsumerOptions(opts)
+	handler = Chain(handler, o.middlewares...)
+
+	named := o.queue != ""
+	queueName := o.queue
+	if !named {
+		queueName = "amq.gen-" + NewMessageId()
+	}
+	c := &pgConsumer{
+		b:      b,
+		router: b.routes.router(queueName, named, o.bindings),
+		ack:    newSerialAcknowledger(queueName, fmt.Sprintf("ctag-%d", b.consumers.Add(1)), o.autoAck),
+	}
+
+	ctx, cancel := context.WithCancel(global.CancellationContext())
+	defer cancel()
+	go func() {
+		select {
+		case <-b.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	msgs := make(chan amqp091.Delivery)
+	go c.run(ctx, msgs)
+
+	log.Printf(" [*] Waiting for messages from queue: %s. To exit press CTRL+C", queueName)
+	receive(queueName, msgs, handler, o, c.ack.retry)
+	log.Printf("Postgres receiver for queue %s stopped", queueName)
+}
+
+// prune deletes expired messages hourly until Shutdown or the global context
+// is cancelled.
+func (b *PostgresBroker) prune() {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-b.done:
+			return
+		case <-global.CancellationContext().Done():
+			return
+		case <-ticker.C:
+			if err := db.Postgres().ExecNonQuery(functions.PruneBrokerMessages, b.retention.Seconds()); err != nil {
+				loggers.Zap.Errorf("PG Error: %s", err.Error())
+			}
+		}
+	}
+}
+
+// Shutdown stops all consumers and the Publisher. Stored messages are kept.
+func (b *PostgresBroker) Shutdown() {
+	b.once.Do(func() {
+		log.Println("Closing Postgres message broker...")
+		close(b.done)
+		b.p.Shutdown()
+		log.Println("Postgres message broker closed")
+	})
+}
+
+// pgConsumer reads the messages of one Consume call.
+type pgConsumer struct {
+	b      *PostgresBroker
+	router *consumerRouter
+	ack    *serialAcknowledger
+	lastId int64
+}
+
+// run delivers messages to msgs until ctx is cancelled, starting a new
+// listening session whenever the previous one fails.
+func (c *pgConsumer) run(ctx context.Context, msgs chan<- amqp091.Delivery) {
+	defer close(msgs)
+	for {
+		err := c.session(ctx, msgs)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			loggers.Zap.Errorf("Postgres broker error on queue %s: %s", c.router.queue, err.Error())
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(c.b.pollInterval):
+		}
+	}
+}
+
+func (c *pgConsumer) session(ctx context.Context, msgs chan<- amqp091.Delivery) error {
+	conn, err := db.Postgres().Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	if c.router.named {
+		if err := c.lock(ctx, conn); err != nil {
+			return err
+		}
+		defer func() {
+			if _, err := conn.Exec(context.Background(), functions.UnlockBrokerQueue, c.router.queue); err != nil {
+				loggers.Zap.Errorf("PG Error: %s", err.Error())
+			}
+		}()
+	}
+
+	if _, err := conn.Exec(ctx, functions.ListenBroker); err != nil {
+		return err
+	}
+	defer func() {
+		_, _ = conn.Exec(context.Background(), "UNLISTEN *")
+	}()
+
+	switch {
+	case c.router.named:
+		if _, err := conn.Exec(ctx, functions.InitBrokerOffset, c.router.queue); err != nil {
+			return err
+		}
+		if err := conn.QueryRow(ctx, functions.SelectBrokerOffset, c.router.queue).Scan(&c.lastId); err != nil {
+			return err
+		}
+	case c.lastId == 0:
+		// Consumers without a queue start at the latest message and catch up
+		// from where they were after a reconnect
+		if err := conn.QueryRow(ctx, functions.SelectLatestBrokerMessageId).Scan(&c.lastId); err != nil {
+			return err
+		}
+	}
+
+	if err := c.catchUp(ctx, conn, msgs); err != nil {
+		return err
+	}
+	for {
+		waitCtx, cancel := context.WithTimeout(ctx, c.b.pollInterval)
+		n, err := conn.Conn().WaitForNotification(waitCtx)
+		cancel()
+		if err != nil {
+			if errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil {
+				if err := c.catchUp(ctx, conn, msgs); err != nil {
+					return err
+				}
+				continue
+			}
+			return err
+		}
+
+		var m pgMessage
+		if err := json.Unmarshal([]byte(n.Payload), &m); err != nil {
+			loggers.Zap.Errorf("Postgres broker received a malformed notification: %s", err.Error())
+			continue
+		}
+		switch {
+		case m.Id <= c.lastId:
+		case m.Id == c.lastId+1 && m.Inline:
+			if err := c.deliver(ctx, conn, msgs, m); err != nil {
+				return err
+			}
+		default:
+			// A gap or a message too large to be notified
+			if err := c.catchUp(ctx, conn, msgs); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// lock waits until this consumer holds the named queue.
+func (c *pgConsumer) lock(ctx context.Context, conn *pgxpool.Conn) error {
+	for {
+		var locked bool
+		if err := conn.QueryRow(ctx, functions.TryLockBrokerQueue, c.router.queue).Scan(&locked); err != nil {
+			return err
+		}
+		if locked {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(c.b.pollInterval):
+		}
+	}
+}
+
+// catchUp delivers every stored message after the last one handled.
+func (c *pgConsumer) catchUp(ctx context.Context, conn *pgxpool.Conn, msgs chan<- amqp091.Delivery) error {
+	for {
+		rows, err := conn.Query(ctx, functions.SelectBrokerMessages, c.lastId, c.b.batchSize)
+		if err != nil {
+			return err
+		}
+		batch, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (pgMessage, error) {
+			var m pgMessage
+			err := row.Scan(&m.Id, &m.Exchange, &m.RoutingKey, &m.MessageId, &m.CorrelationId, &m.Type,
+				&m.ContentType, &m.ContentEncoding, &m.AppId, &m.Headers, &m.Body, &m.CreatedAt)
+			return m, err
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, m := range batch {
+			if err := c.deliver(ctx, conn, msgs, m); err != nil {
+				return err
+			}
+		}
+		if len(batch) < c.b.batchSize {
+			return nil
+		}
+	}
+}
+
+// deliver hands m to the handler if the consumer is bound to it and then
+// moves the consumer's offset past it.
+func (c *pgConsumer) deliver(ctx context.Context, conn *pgxpool.Conn, msgs chan<- amqp091.Delivery, m pgMessage) error {
+	if c.router.routes(m.Exchange, m.RoutingKey) {
+		if err := c.ack.deliver(ctx, msgs, m.delivery()); err != nil {
+			return err
+		}
+	}
+
+	c.lastId = m.Id
+	if c.router.named {
+		if _, err := conn.Exec(ctx, functions.UpdateBrokerOffset, c.router.queue, m.Id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,413 @@
+package messagebrokers
+
+import (
+	"context"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// OverflowPolicy decides what happens when a subscriber's buffer is full.
+type OverflowPolicy int
+
+const (
+	// BlockWithTimeout waits up to the block timeout for buffer space, then
+	// drops the message. The wait happens on a goroutine of the subscription,
+	// and messages arriving meanwhile queue up behind it, up to the buffer
+	// size, so delivery to other subscribers is never held up.
+	BlockWithTimeout OverflowPolicy = iota
+	// DropNewest discards the incoming message.
+	DropNewest
+	// DropOldest discards the oldest buffered message to make room.
+	DropOldest
+	// Disconnect removes the subscriber, closing its channel if the Publisher owns it.
+	Disconnect
+)
+
+const (
+	defaultSubscriberBuffer = 64
+	defaultBlockTimeout     = time.Second
+)
+
+type subscriberOptions struct {
+	bufferSize   int
+	policy       OverflowPolicy
+	blockTimeout time.Duration
+	filter       func(msg any) bool
+	topics       []string
+	skipReplay   bool
+	lastValues   bool
+}
+
+type SubscriberOption func(*subscriberOptions)
+
+// WithBufferSize sets how many messages are buffered for the subscriber.
+func WithBufferSize(size int) SubscriberOption {
+	return func(o *subscriberOptions) {
+		o.bufferSize = size
+	}
+}
+
+// WithOverflowPolicy selects what happens when the subscriber's buffer is full.
+func WithOverflowPolicy(policy OverflowPolicy) SubscriberOption {
+	return func(o *subscriberOptions) {
+		o.policy = policy
+	}
+}
+
+// WithBlockTimeout bounds how long BlockWithTimeout waits for buffer space.
+func WithBlockTimeout(timeout time.Duration) SubscriberOption {
+	return func(o *subscriberOptions) {
+		o.blockTimeout = timeout
+	}
+}
+
+// WithFilter only delivers messages for which predicate returns true. T must
+// match the Publisher's message type.
+func WithFilter[T any](predicate func(msg T) bool) SubscriberOption {
+	return func(o *subscriberOptions) {
+		o.filter = func(msg any) bool {
+			m, ok := msg.(T)
+			return ok && predicate(m)
+		}
+	}
+}
+
+// WithTopics only delivers messages whose routing key matches one of the
+// patterns, using AMQP topic syntax: * matches one word and # zero or more.
+func WithTopics(patterns ...string) SubscriberOption {
+	return func(o *subscriberOptions) {
+		o.topics = append(o.topics, patterns...)
+	}
+}
+
+// Subscription is a subscriber registered with a Publisher. Messages are
+// buffered per subscription and handed to its channel by a dedicated
+// goroutine, so a slow subscriber never holds up the others.
+type Subscription[T any] struct {
+	p      *Publisher[T]
+	out    chan T
+	buffer chan T
+	opts   subscriberOptions
+	drops  atomic.Uint64
+	done   chan struct{}
+	once   sync.Once
+	// owned is set when the Publisher created out and is responsible for closing it
+	owned bool
+
+	// overflow holds the messages waiting for buffer space under
+	// BlockWithTimeout while draining is set
+	overflowMutex *sync.Mutex
+	overflow      []T
+	draining      bool
+}
+
+// C returns the channel messages are delivered on.
+func (s *Subscription[T]) C() <-chan T {
+	return s.out
+}
+
+// Unsubscribe stops delivery. The channel is closed if it was created by
+// Publisher.Subscribe. It is safe to call more than once.
+func (s *Subscription[T]) Unsubscribe() {
+	s.p.remove(s)
+}
+
+// accepts reports whether the subscription wants a message with routingKey.
+func (s *Subscription[T]) accepts(routingKey string, msg T) bool {
+	if len(s.opts.topics) != 0 {
+		matched := false
+		for _, pattern := range s.opts.topics {
+			if matchTopic(pattern, routingKey) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return s.opts.filter == nil || s.opts.filter(msg)
+}
+
+// Drops returns the number of messages discarded for this subscription.
+func (s *Subscription[T]) Drops() uint64 {
+	return s.drops.Load()
+}
+
+// pump forwards buffered messages until the subscription is stopped, then
+// closes the subscriber channel if the Publisher owns it.
+func (s *Subscription[T]) pump() {
+	defer func() {
+		if s.owned {
+			close(s.out)
+		}
+	}()
+	for {
+		select {
+		case <-s.done:
+			return
+		case msg := <-s.buffer:
+			select {
+			case s.out <- msg:
+			case <-s.done:
+				return
+			}
+		}
+	}
+}
+
+func (s *Subscription[T]) stop() {
+	s.once.Do(func() {
+		close(s.done)
+	})
+}
+
+// offer buffers msg according to the overflow policy without blocking. It
+// returns false if the subscriber has to be disconnected.
+func (s *Subscription[T]) offer(msg T) bool {
+	if s.opts.policy == BlockWithTimeout {
+		// Keep the order of messages already waiting for space
+		s.overflowMutex.Lock()
+		draining := s.draining
+		s.overflowMutex.Unlock()
+		if draining {
+			s.enqueueOverflow(msg)
+			return true
+		}
+	}
+	select {
+	case s.buffer <- msg:
+		return true
+	default:
+	}
+
+	switch s.opts.policy {
+	case DropNewest:
+		s.drops.Add(1)
+	case DropOldest:
+		for {
+			select {
+			case s.buffer <- msg:
+				return true
+			default:
+			}
+			select {
+			case <-s.buffer:
+				s.drops.Add(1)
+			default:
+			}
+		}
+	case Disconnect:
+		s.drops.Add(1)
+		return false
+	default:
+		s.enqueueOverflow(msg)
+	}
+	return true
+}
+
+// enqueueOverflow queues msg for the drain goroutine, starting it if needed.
+// Once as many messages wait as the buffer holds, further ones are dropped.
+func (s *Subscription[T]) enqueueOverflow(msg T) {
+	s.overflowMutex.Lock()
+	defer s.overflowMutex.Unlock()
+	if len(s.overflow) >= cap(s.buffer) {
+		s.drops.Add(1)
+		return
+	}
+	s.overflow = append(s.overflow, msg)
+	if !s.draining {
+		s.draining = true
+		go s.drain()
+	}
+}
+
+// drain moves queued overflow messages into the buffer in order, waiting up
+// to the block timeout for each before dropping it.
+func (s *Subscription[T]) drain() {
+	timer := time.NewTimer(s.opts.blockTimeout)
+	defer timer.Stop()
+	for {
+		s.overflowMutex.Lock()
+		if len(s.overflow) == 0 {
+			s.draining = false
+			s.overflowMutex.Unlock()
+			return
+		}
+		msg := s.overflow[0]
+		s.overflow = s.overflow[1:]
+		s.overflowMutex.Unlock()
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(s.opts.blockTimeout)
+		select {
+		case s.buffer <- msg:
+		case <-timer.C:
+			s.drops.Add(1)
+		case <-s.done:
+			s.overflowMutex.Lock()
+			s.overflow = nil
+			s.draining = false
+			s.overflowMutex.Unlock()
+			return
+		}
+	}
+}
+
+// Publisher fans messages received from RabbitMQ out to in-process subscribers.
+type Publisher[T any] struct {
+	messages chan T
+	subs     []*Subscription[T]
+	mutex    *sync.RWMutex
+
+	history      []retained[T]
+	replaySize   int
+	replayWindow time.Duration
+	lastValueKey LastValueKey[T]
+	lastValues   map[string]retained[T]
+	// retained counts retained messages, numbering them for replay
+	retained uint64
+}
+
+func NewPublisher[T any](opts ...PublisherOption[T]) *Publisher[T] {
+	p := &Publisher[T]{
+		messages: make(chan T),
+		subs:     make([]*Subscription[T], 0),
+		mutex:    new(sync.RWMutex),
+	}
+	for _, fn := range opts {
+		fn(p)
+	}
+	return p
+}
+
+// publishMessage buffers body for every interested subscriber. It never
+// waits for a subscriber, so a full or abandoned one cannot hold up the
+// delivery goroutine or the other subscribers.
+func (p *Publisher[T]) publishMessage(routingKey string, body T) {
+	p.mutex.Lock()
+	p.retainLocked(routingKey, body)
+	subs := append([]*Subscription[T](nil), p.subs...)
+	p.mutex.Unlock()
+
+	for _, sub := range subs {
+		if !sub.accepts(routingKey, body) {
+			continue
+		}
+		if !sub.offer(body) {
+			p.remove(sub)
+		}
+	}
+}
+
+func (p *Publisher[T]) remove(sub *Subscription[T]) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for i, s := range p.subs {
+		if s == sub {
+			p.subs = append(p.subs[:i], p.subs[i+1:]...)
+			break
+		}
+	}
+	sub.stop()
+}
+
+// Subscribe registers a subscription with a channel owned by the Publisher.
+// The subscription is removed and its channel closed when ctx is cancelled
+// or Unsubscribe is called. By default up to 64 messages are buffered and a
+// message waits a second for space before it is dropped. Retained
+// messages are replayed first when the Publisher has a replay buffer.
+func (p *Publisher[T]) Subscribe(ctx context.Context, opts ...SubscriberOption) *Subscription[T] {
+	s := p.subscribe(make(chan T), true, opts)
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.Unsubscribe()
+		case <-s.done:
+		}
+	}()
+	return s
+}
+
+// SubscribeMessages delivers messages to sub, which stays owned by the caller
+// and is never closed by the Publisher.
+func (p *Publisher[T]) SubscribeMessages(sub chan T, opts ...SubscriberOption) *Subscription[T] {
+	return p.subscribe(sub, false, opts)
+}
+
+func (p *Publisher[T]) subscribe(out chan T, owned bool, opts []SubscriberOption) *Subscription[T] {
+	o := subscriberOptions{
+		bufferSize:   defaultSubscriberBuffer,
+		policy:       BlockWithTimeout,
+		blockTimeout: defaultBlockTimeout,
+	}
+	for _, fn := range opts {
+		fn(&o)
+	}
+
+	s := &Subscription[T]{
+		p:             p,
+		out:           out,
+		opts:          o,
+		done:          make(chan struct{}),
+		owned:         owned,
+		overflowMutex: new(sync.Mutex),
+	}
+
+	// The backlog is buffered while holding the lock, so no message is
+	// delivered both by replay and live, and none is missed in between.
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	backlog := p.backlogLocked(s)
+	s.buffer = make(chan T, max(o.bufferSize, len(backlog)))
+	for _, msg := range backlog {
+		s.buffer <- msg
+	}
+	p.subs = append(p.subs, s)
+	go s.pump()
+	return s
+}
+
+// Shutdown stops every subscription, closing the channels the Publisher owns.
+func (p *Publisher[T]) Shutdown() {
+	log.Println("Closing all RabbitMq messaging subscribers")
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for _, sub := range p.subs {
+		sub.stop()
+	}
+	p.subs = nil
+	log.Println("Closed all RabbitMq messaging subscribers")
+}
+
+// matchTopic reports whether key matches an AMQP topic pattern.
+func matchTopic(pattern, key string) bool {
+	return matchWords(strings.Split(pattern, "."), strings.Split(key, "."))
+}
+
+func matchWords(pattern, key []string) bool {
+	if len(pattern) == 0 {
+		return len(key) == 0
+	}
+	switch pattern[0] {
+	case "#":
+		for i := 0; i <= len(key); i++ {
+			if matchWords(pattern[1:], key[i:]) {
+				return true
+			}
+		}
+		return false
+	case "*":
+		return len(key) != 0 && matchWords(pattern[1:], key[1:])
+	default:
+		return len(key) != 0 && pattern[0] == key[0] && matchWords(pattern[1:], key[1:])
+	}
+}
@@ -0,0 +1,149 @@
+package messagebrokers
+
+import (
+	"sort"
+	"time"
+)
+
+// PublisherOption configures a Publisher.
+type PublisherOption[T any] func(*Publisher[T])
+
+// LastValueKey derives the last-value cache key of a message.
+type LastValueKey[T any] func(routingKey string, msg T) string
+
+// retained is a message kept for replay or in the last-value cache.
+type retained[T any] struct {
+	seq        uint64
+	routingKey string
+	msg        T
+	at         time.Time
+}
+
+// WithReplayBuffer keeps the last size messages that are no older than
+// window and replays them to new subscribers. A size of zero keeps every
+// message of the window, and a window of zero keeps the last size messages
+// however old they are.
+func WithReplayBuffer[T any](size int, window time.Duration) PublisherOption[T] {
+	return func(p *Publisher[T]) {
+		p.replaySize = size
+		p.replayWindow = window
+	}
+}
+
+// WithLastValueCache keeps the latest message for every key returned by key.
+// Messages with an empty key are not cached.
+func WithLastValueCache[T any](key LastValueKey[T]) PublisherOption[T] {
+	return func(p *Publisher[T]) {
+		p.lastValueKey = key
+		p.lastValues = make(map[string]retained[T])
+	}
+}
+
+// WithoutReplay skips the replay of retained messages on subscribe.
+func WithoutReplay() SubscriberOption {
+	return func(o *subscriberOptions) {
+		o.skipReplay = true
+	}
+}
+
+// WithLastValues delivers the last-value cache on subscribe, merged with any
+// replayed messages in publish order and before live ones. Cached messages
+// are not replayed a second time, and the subscription's topics and filter
+// apply to them as well.
+func WithLastValues() SubscriberOption {
+	return func(o *subscriberOptions) {
+		o.lastValues = true
+	}
+}
+
+// LastValue returns the latest message cached for key.
+func (p *Publisher[T]) LastValue(key string) (T, bool) {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	r, ok := p.lastValues[key]
+	return r.msg, ok
+}
+
+// LastValues returns a copy of the last-value cache.
+func (p *Publisher[T]) LastValues() map[string]T {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	values := make(map[string]T, len(p.lastValues))
+	for k, r := range p.lastValues {
+		values[k] = r.msg
+	}
+	return values
+}
+
+// retainLocked records a message for replay and in the last-value cache.
+// It must be called with p.mutex held for writing.
+func (p *Publisher[T]) retainLocked(routingKey string, msg T) {
+	p.retained++
+	r := retained[T]{seq: p.retained, routingKey: routingKey, msg: msg, at: time.Now()}
+
+	if p.lastValueKey != nil {
+		if key := p.lastValueKey(routingKey, msg); key != "" {
+			p.lastValues[key] = r
+		}
+	}
+	if p.replaySize <= 0 && p.replayWindow <= 0 {
+		return
+	}
+	p.history = append(p.history, r)
+	if p.replaySize > 0 && len(p.history) > p.replaySize {
+		p.history = p.history[len(p.history)-p.replaySize:]
+	}
+	p.pruneHistoryLocked(r.at)
+}
+
+// pruneHistoryLocked drops retained messages older than the replay window.
+func (p *Publisher[T]) pruneHistoryLocked(now time.Time) {
+	if p.replayWindow <= 0 {
+		return
+	}
+	cutoff := now.Add(-p.replayWindow)
+	expired := 0
+	for expired < len(p.history) && p.history[expired].at.Before(cutoff) {
+		expired++
+	}
+	if expired != 0 {
+		p.history = append(p.history[:0], p.history[expired:]...)
+	}
+}
+
+// backlogLocked returns the messages a new subscription starts with, in the
+// order they were published, so the newest value of every cached key comes
+// last. It must be called with p.mutex held.
+func (p *Publisher[T]) backlogLocked(s *Subscription[T]) []T {
+	entries := make([]retained[T], 0)
+	delivered := make(map[uint64]bool)
+	if s.opts.lastValues {
+		for _, r := range p.lastValues {
+			if s.accepts(r.routingKey, r.msg) {
+				entries = append(entries, r)
+				delivered[r.seq] = true
+			}
+		}
+	}
+	if !s.opts.skipReplay {
+		cutoff := time.Time{}
+		if p.replayWindow > 0 {
+			cutoff = time.Now().Add(-p.replayWindow)
+		}
+		for _, r := range p.history {
+			if r.at.Before(cutoff) || delivered[r.seq] || !s.accepts(r.routingKey, r.msg) {
+				continue
+			}
+			entries = append(entries, r)
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].seq < entries[j].seq
+	})
+	backlog := make([]T, 0, len(entries))
+	for _, r := range entries {
+		backlog = append(backlog, r.msg)
+	}
+	return backlog
+}
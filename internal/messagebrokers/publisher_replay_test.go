@@ -0,0 +1,121 @@
+package messagebrokers
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestPublisherReplayBySize(t *testing.T) {
+	p := NewPublisher(WithReplayBuffer[int](2, 0))
+	defer p.Shutdown()
+	for i := 1; i <= 3; i++ {
+		p.publishMessage("", i)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := p.Subscribe(ctx)
+	for _, want := range []int{2, 3} {
+		if n := receiveWithin(t, s.C(), time.Second); n != want {
+			t.Fatalf("replayed %d, want %d", n, want)
+		}
+	}
+	receiveNone(t, s.C(), 50*time.Millisecond)
+
+	skipped := p.Subscribe(ctx, WithoutReplay())
+	receiveNone(t, skipped.C(), 50*time.Millisecond)
+}
+
+func TestPublisherReplayByWindowOnly(t *testing.T) {
+	p := NewPublisher(WithReplayBuffer[int](0, 100*time.Millisecond))
+	defer p.Shutdown()
+
+	p.publishMessage("", 1)
+	time.Sleep(150 * time.Millisecond)
+	p.publishMessage("", 2)
+	p.publishMessage("", 3)
+
+	p.mutex.RLock()
+	retainedCount := len(p.history)
+	p.mutex.RUnlock()
+	if retainedCount != 2 {
+		t.Fatalf("history holds %d messages, want the 2 inside the window", retainedCount)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := p.Subscribe(ctx)
+	for _, want := range []int{2, 3} {
+		if n := receiveWithin(t, s.C(), time.Second); n != want {
+			t.Fatalf("replayed %d, want %d", n, want)
+		}
+	}
+	receiveNone(t, s.C(), 50*time.Millisecond)
+}
+
+func TestPublisherLastValuesMergeWithReplay(t *testing.T) {
+	type price struct {
+		Symbol string
+		Value  int
+	}
+	p := NewPublisher(
+		WithReplayBuffer[price](10, 0),
+		WithLastValueCache(func(_ string, msg price) string { return msg.Symbol }),
+	)
+	defer p.Shutdown()
+
+	p.publishMessage("", price{"A", 1})
+	p.publishMessage("", price{"A", 2})
+	p.publishMessage("", price{"B", 1})
+
+	if v, ok := p.LastValue("A"); !ok || v.Value != 2 {
+		t.Fatalf("last value of A is %+v", v)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := p.Subscribe(ctx, WithLastValues())
+
+	// Merged in publish order, so the latest value of A arrives after the older one
+	for _, want := range []price{{"A", 1}, {"A", 2}, {"B", 1}} {
+		if got := receiveWithin(t, s.C(), time.Second); got != want {
+			t.Fatalf("received %+v, want %+v", got, want)
+		}
+	}
+	receiveNone(t, s.C(), 50*time.Millisecond)
+
+	// Without a replay buffer only the cached values arrive, also in publish order
+	cached := p.Subscribe(ctx, WithLastValues(), WithoutReplay())
+	for _, want := range []price{{"A", 2}, {"B", 1}} {
+		if got := receiveWithin(t, cached.C(), time.Second); got != want {
+			t.Fatalf("received %+v, want %+v", got, want)
+		}
+	}
+	receiveNone(t, cached.C(), 50*time.Millisecond)
+}
+
+func TestPublisherLastValuesFollowTopicsAndFilter(t *testing.T) {
+	p := NewPublisher(WithLastValueCache(func(routingKey string, _ int) string { return routingKey }))
+	defer p.Shutdown()
+
+	p.publishMessage("orders.a", 1)
+	p.publishMessage("users.b", 2)
+	p.publishMessage("orders.c", 3)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	orders := p.Subscribe(ctx, WithLastValues(), WithTopics("orders.#"))
+	for _, want := range []int{1, 3} {
+		if got := receiveWithin(t, orders.C(), time.Second); got != want {
+			t.Fatalf("topic subscriber received %d, want %d", got, want)
+		}
+	}
+	receiveNone(t, orders.C(), 50*time.Millisecond)
+
+	even := p.Subscribe(ctx, WithLastValues(), WithFilter(func(n int) bool { return n%2 == 0 }))
+	if got := receiveWithin(t, even.C(), time.Second); got != 2 {
+		t.Fatalf("filtered subscriber received %d, want 2", got)
+	}
+	receiveNone(t, even.C(), 50*time.Millisecond)
+}
@@ -0,0 +1,154 @@
+package messagebrokers
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestPublisherDropPolicies(t *testing.T) {
+	p := NewPublisher[int]()
+	defer p.Shutdown()
+
+	// Nobody reads the channels, so one message sits in the pump and one in the buffer
+	newest := p.SubscribeMessages(make(chan int), WithBufferSize(1), WithOverflowPolicy(DropNewest))
+	oldest := p.SubscribeMessages(make(chan int), WithBufferSize(1), WithOverflowPolicy(DropOldest))
+	disconnect := p.SubscribeMessages(make(chan int), WithBufferSize(1), WithOverflowPolicy(Disconnect))
+
+	for i := 1; i <= 4; i++ {
+		p.publishMessage("", i)
+		// Let the pumps take the first message out of the buffer
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if drops := newest.Drops(); drops != 2 {
+		t.Errorf("DropNewest dropped %d messages, want 2", drops)
+	}
+	if drops := oldest.Drops(); drops != 2 {
+		t.Errorf("DropOldest dropped %d messages, want 2", drops)
+	}
+	if got := <-oldest.buffer; got != 4 {
+		t.Errorf("DropOldest kept %d, want the newest message 4", got)
+	}
+
+	select {
+	case <-disconnect.done:
+	default:
+		t.Error("Disconnect subscriber still registered")
+	}
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	for _, s := range p.subs {
+		if s == disconnect {
+			t.Error("Disconnect subscriber still in the subscriber list")
+		}
+	}
+}
+
+func TestPublisherBlockedSubscriberDoesNotHoldUpOthers(t *testing.T) {
+	p := NewPublisher[int]()
+	defer p.Shutdown()
+
+	// An abandoned legacy subscriber with the default BlockWithTimeout policy
+	abandoned := p.SubscribeMessages(make(chan int), WithBufferSize(1), WithBlockTimeout(time.Hour))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	live := p.Subscribe(ctx, WithBufferSize(100))
+
+	start := time.Now()
+	for i := 0; i < 50; i++ {
+		p.publishMessage("", i)
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Fatalf("publishing took %s behind a blocked subscriber", elapsed)
+	}
+	for i := 0; i < 50; i++ {
+		if n := receiveWithin(t, live.C(), time.Second); n != i {
+			t.Fatalf("live subscriber got %d, want %d", n, i)
+		}
+	}
+	if abandoned.Drops() == 0 {
+		t.Error("overflow of the abandoned subscriber was not counted as dropped")
+	}
+}
+
+func TestPublisherBlockWithTimeoutKeepsOrder(t *testing.T) {
+	p := NewPublisher[int]()
+	defer p.Shutdown()
+
+	// Two messages fit in the buffer and two more wait behind it
+	out := make(chan int)
+	p.SubscribeMessages(out, WithBufferSize(2), WithBlockTimeout(time.Second))
+
+	for i := 0; i < 4; i++ {
+		p.publishMessage("", i)
+	}
+	for i := 0; i < 4; i++ {
+		if n := receiveWithin(t, out, time.Second); n != i {
+			t.Fatalf("got %d, want %d", n, i)
+		}
+	}
+}
+
+func TestMatchTopic(t *testing.T) {
+	tests := []struct {
+		pattern, key string
+		want         bool
+	}{
+		{"orders.created", "orders.created", true},
+		{"orders.created", "orders.deleted", false},
+		{"orders.*", "orders.created", true},
+		{"orders.*", "orders", false},
+		{"orders.*", "orders.eu.created", false},
+		{"orders.#", "orders", true},
+		{"orders.#", "orders.eu.created", true},
+		{"#.created", "orders.eu.created", true},
+		{"#", "", true},
+		{"*.*.created", "orders.eu.created", true},
+	}
+	for _, tt := range tests {
+		if got := matchTopic(tt.pattern, tt.key); got != tt.want {
+			t.Errorf("matchTopic(%q, %q) = %t, want %t", tt.pattern, tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestPublisherTopicsAndFilter(t *testing.T) {
+	p := NewPublisher[int]()
+	defer p.Shutdown()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	orders := p.Subscribe(ctx, WithTopics("orders.#"))
+	even := p.Subscribe(ctx, WithFilter(func(n int) bool { return n%2 == 0 }))
+
+	p.publishMessage("orders.created", 1)
+	p.publishMessage("users.created", 2)
+
+	if n := receiveWithin(t, orders.C(), time.Second); n != 1 {
+		t.Fatalf("topic subscriber got %d, want 1", n)
+	}
+	receiveNone(t, orders.C(), 50*time.Millisecond)
+	if n := receiveWithin(t, even.C(), time.Second); n != 2 {
+		t.Fatalf("filtered subscriber got %d, want 2", n)
+	}
+}
+
+func TestPublisherUnsubscribeClosesOwnedChannel(t *testing.T) {
+	p := NewPublisher[int]()
+	defer p.Shutdown()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s := p.Subscribe(ctx)
+	cancel()
+
+	select {
+	case _, ok := <-s.C():
+		if ok {
+			t.Fatal("received a message after cancel")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("channel not closed after the context was cancelled")
+	}
+}
@@ -1,13 +1,10 @@
 package messagebrokers
 
 import (
-	"context"
-	"encoding/json"
 	"fmt"
 	"github.com/Roh-Bot/rabbitmq-pub-sub/internal/config"
 	"github.com/Roh-Bot/rabbitmq-pub-sub/internal/db"
 	"github.com/Roh-Bot/rabbitmq-pub-sub/internal/db/functions"
-	"github.com/Roh-Bot/rabbitmq-pub-sub/pkg/global"
 	"github.com/Roh-Bot/rabbitmq-pub-sub/pkg/loggers"
 	"github.com/rabbitmq/amqp091-go"
 	"log"
@@ -18,193 +15,107 @@ import (
 var rabbitMQ *RabbitMq
 
 type RabbitMq struct {
-	conn *amqp091.Connection
+	// conn carries publishes and consumeConn carries consumers
+	conn        *amqp091.Connection
+	consumeConn *amqp091.Connection
+	// ch is the control channel topology is declared on
 	ch   *amqp091.Channel
-	p    *Publisher
-}
-
-type Publisher struct {
-	messages chan map[string]any
-	subs     []chan map[string]any
-	mutex    *sync.RWMutex
+	pool *channelPool
+	p    *Publisher[map[string]any]
+	// endpoints are the broker nodes dialled on connect and reconnect
+	endpoints *endpointPool
+	// node and consumeNode are the host and port of the broker nodes conn
+	// and consumeConn are connected to
+	node        string
+	consumeNode string
+	// declared holds the topologies passed to Declare, re-declared on reconnect
+	declared []config.Topology
+	// dialConfig carries the TLS, SASL and tuning settings used for every dial
+	dialConfig amqp091.Config
+
+	mutex     *sync.RWMutex
+	state     ConnectionState
+	stateSubs []chan ConnectionState
+	// changed is closed and replaced on every state transition
+	changed chan struct{}
+
+	flow     FlowControl
+	flowSubs []chan FlowControl
+	// unpaused is closed while the broker allows publishing
+	unpaused      chan struct{}
+	returnHandler ReturnHandler
 }
 
 func RabbitMQConnect() error {
 	log.Println("Connecting to RabbitMq")
 
-	url := fmt.Sprintf(
-		"amqp://%s:%s@%s:%d/",
-		config.GetConfig().RabbitMQ.User,
-		config.GetConfig().RabbitMQ.Password,
-		config.GetConfig().RabbitMQ.Host,
-		config.GetConfig().RabbitMQ.Port)
-
-	conn, err := amqp091.Dial(url)
+	dialConfig, err := dialConfig()
 	if err != nil {
 		loggers.Zap.Errorf("RabbitMQ Error: %s", err.Error())
 		return err
 	}
 
-	if conn.IsClosed() {
-		loggers.Zap.Errorf("RabbitMQ connection is closed")
-		return fmt.Errorf("RabbitMQ connection is closed")
-	}
-
-	ch, err := conn.Channel()
+	endpoints, err := newEndpointPool()
 	if err != nil {
 		loggers.Zap.Errorf("RabbitMQ Error: %s", err.Error())
 		return err
 	}
 
-	rabbitMQ = &RabbitMq{
-		conn: conn,
-		ch:   ch,
+	r := &RabbitMq{
+		endpoints:  endpoints,
+		dialConfig: dialConfig,
+		mutex:      new(sync.RWMutex),
+		state:      StateConnecting,
+		changed:    make(chan struct{}),
+		unpaused:   make(chan struct{}),
 	}
-	rabbitMQ.p = &Publisher{
-		messages: make(chan map[string]any),
-		subs:     make([]chan map[string]any, 0),
-		mutex:    new(sync.RWMutex),
+	close(r.unpaused)
+	r.p = NewPublisher(publisherOptions()...)
+	if err := r.dial(); err != nil {
+		return err
 	}
-	log.Println("Connected to RabbitMQ")
+
+	rabbitMQ = r
+	log.Printf("Connected to RabbitMQ node %s", r.Node())
 	return nil
 }
 
+// publisherOptions builds the options of the built-in Publisher from the
+// rabbitmq.publisher section.
+func publisherOptions() []PublisherOption[map[string]any] {
+	cfg := config.GetConfig().RabbitMQ.Publisher
+	opts := []PublisherOption[map[string]any]{
+		WithReplayBuffer[map[string]any](cfg.ReplaySize, time.Duration(cfg.ReplayWindow)*time.Second),
+	}
+	if cfg.LastValueKey != "" {
+		opts = append(opts, WithLastValueCache(func(_ string, msg map[string]any) string {
+			if v, ok := msg[cfg.LastValueKey]; ok {
+				return fmt.Sprint(v)
+			}
+			return ""
+		}))
+	}
+	return opts
+}
+
 func RabbitMQ() *RabbitMq {
 	return rabbitMQ
 }
 
-func (r *RabbitMq) Publisher() *Publisher {
+func (r *RabbitMq) Publisher() *Publisher[map[string]any] {
 	return r.p
 }
 
+// SendMessages publishes body to the configured exchange. Queues are bound
+// when they are declared, so publishing is a single confirmed publish.
 func (r *RabbitMq) SendMessages(body map[string]any) {
-	if r.conn.IsClosed() || r.ch.IsClosed() {
-		loggers.Zap.Errorf("RabbitMQ connection/channel is closed")
-		return
-	}
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-	bodyBytes, err := json.Marshal(body)
-	if err != nil {
-		log.Println(err)
-		return
-	}
-
-	var queues []string
-	rows, err := db.Postgres().Read(functions.GetAllQueues)
-	if err != nil {
-		loggers.Zap.Errorf("PG Error: %s", err.Error())
-		return
-	}
-	for rows.Next() {
-		err := rows.Scan(&queues)
-		if err != nil {
-			loggers.Zap.Errorf("PG Error: %s", err.Error())
-			return
-		}
-	}
-
-	for _, queue := range queues {
-		err := r.ch.QueueBind(
-			queue,
-			"",
-			config.GetConfig().RabbitMQ.Exchange,
-			false,
-			nil,
-		)
-		if err != nil {
-			return
-		}
-	}
-
-	err = r.ch.PublishWithContext(
-		ctx,
-		config.GetConfig().RabbitMQ.Exchange,
-		"",
-		false,
-		false,
-		amqp091.Publishing{
-			ContentType: "application/json",
-			Body:        bodyBytes,
-		})
-	if err != nil {
-		loggers.Zap.Errorf("%s : %s", err, "Failed to publish a message")
-		return
-	}
-
-	log.Printf("RABBITMQ MESSAGE SENT: Sent %v\n", body)
-	return
+	SendMessages(r, body)
 }
 
-func (r *RabbitMq) ReceiveMessages(wg *sync.WaitGroup) {
-	defer wg.Done()
-
-	if r.conn.IsClosed() || r.ch.IsClosed() {
-		log.Println("RabbitMQ connection is already closed")
-		return
-	}
-
-	var queueName string
-	if err := db.PGReadSingleRow(&queueName, functions.GenerateAndGetQueueName); err != nil {
-		log.Println(err)
-		return
-	}
-
-	defer func() {
-		log.Printf("Deleting queue: %s\n", queueName)
-		if err := db.Postgres().ExecNonQuery(functions.DeleteQueue, queueName); err != nil {
-			loggers.Zap.Errorf("PG Error: %s", err.Error())
-			return
-		}
-	}()
-
-	q, err := r.ch.QueueDeclare(
-		queueName, // name
-		false,     // durable
-		false,     // delete when unused
-		true,      // exclusive
-		false,     // no-wait
-		nil,
-	)
-	if err != nil {
-		return
-	}
-	msgs, err := r.ch.Consume(
-		q.Name, // queue
-		"",     // consumer
-		true,   // auto-ack
-		false,  // exclusive
-		false,  // no-local
-		false,  // no-wait
-		nil,
-	)
-	if err != nil {
-		loggers.Zap.Errorf("RabbitMQ Error: %s", err.Error())
-		return
-	}
-
-	log.Printf(" [*] Waiting for messages from queue: %s. To exit press CTRL+C", queueName)
-loop:
-	for {
-		select {
-		case <-global.CancellationContext().Done():
-			log.Println("Exiting RabbitMQ receiver...")
-			break loop
-		case deliver, ok := <-msgs:
-			if !ok {
-				log.Printf("Receiver channel for queue %s has been closed. Exiting...", queueName)
-				break loop
-			}
-			body := make(map[string]any)
-			if err := json.Unmarshal(deliver.Body, &body); err != nil {
-				loggers.Zap.Errorf("RabbitMQ Error: %s", err.Error())
-				break
-			}
-			r.p.publishMessage(body)
-			log.Printf("Received a message: %v", body)
-		}
-	}
-	log.Printf("RabbitMQ receiver for queue %s stopped", queueName)
+// ReceiveMessages consumes from a freshly generated queue and forwards every
+// decoded message to the Publisher. See the package-level ReceiveMessages.
+func (r *RabbitMq) ReceiveMessages(wg *sync.WaitGroup, opts ...ConsumerOption) {
+	ReceiveMessages(wg, r, opts...)
 }
 
 func (*RabbitMq) DeleteAllQueues() {
@@ -216,44 +127,31 @@ func (*RabbitMq) DeleteAllQueues() {
 
 func (r *RabbitMq) Shutdown() {
 	log.Println("Closing rabbit connection...")
-	if r.conn.IsClosed() {
+	r.mutex.Lock()
+	if r.state == StateClosed {
+		r.mutex.Unlock()
 		log.Println("RabbitMQ connection is already closed")
 		return
 	}
-	err := r.conn.Close()
-	if err != nil {
-		loggers.Zap.Errorf("Failed to close connection: %s", err)
-	}
-	log.Println("Rabbit connection closed successfully")
-
-	log.Println("Closing rabbit channel...")
-	err = r.ch.Close()
-	if err != nil {
-		loggers.Zap.Errorf("Failed to close channel: %s", err)
-	}
-	log.Println("Rabbit channel closed successfully")
-}
+	r.setStateLocked(StateClosed)
+	conn, consumeConn, ch, pool := r.conn, r.consumeConn, r.ch, r.pool
+	r.mutex.Unlock()
 
-func (p *Publisher) publishMessage(body map[string]any) {
-	p.mutex.RLock()
-	defer p.mutex.RUnlock()
-	for _, sub := range p.subs {
-		sub <- body
+	log.Println("Closing rabbit channels...")
+	pool.close()
+	if !ch.IsClosed() {
+		if err := ch.Close(); err != nil {
+			loggers.Zap.Errorf("Failed to close channel: %s", err)
+		}
 	}
-}
+	log.Println("Rabbit channels closed successfully")
 
-func (p *Publisher) SubscribeMessages(sub chan map[string]any) {
-	p.mutex.Lock()
-	defer p.mutex.Unlock()
-	p.subs = append(p.subs, sub)
-}
-
-func (p *Publisher) Shutdown() {
-	log.Println("Closing all RabbitMq messaging subscribers")
-	p.mutex.Lock()
-	defer p.mutex.Unlock()
-	for _, sub := range p.subs {
-		close(sub)
+	for _, c := range []*amqp091.Connection{consumeConn, conn} {
+		if !c.IsClosed() {
+			if err := c.Close(); err != nil {
+				loggers.Zap.Errorf("Failed to close connection: %s", err)
+			}
+		}
 	}
-	log.Println("Closed all RabbitMq messaging subscribers")
+	log.Println("Rabbit connections closed successfully")
 }
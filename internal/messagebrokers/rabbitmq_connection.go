@@ -0,0 +1,309 @@
+package messagebrokers
+
+import (
+	"context"
+	"errors"
+	"github.com/Roh-Bot/rabbitmq-pub-sub/internal/config"
+	"github.com/Roh-Bot/rabbitmq-pub-sub/pkg/loggers"
+	"github.com/Roh-Bot/rabbitmq-pub-sub/pkg/utils"
+	"github.com/cenkalti/backoff/v4"
+	"github.com/rabbitmq/amqp091-go"
+	"log"
+	"time"
+)
+
+// consumerReopenDelay spaces out attempts to reopen a consumer channel while
+// the connection itself stays up, so a failing declaration does not spin.
+const consumerReopenDelay = time.Second
+
+// ConnectionState describes where the RabbitMq connection is in its lifecycle.
+type ConnectionState int
+
+const (
+	StateConnecting ConnectionState = iota
+	StateConnected
+	StateReconnecting
+	StateClosed
+)
+
+var ErrConnectionClosed = errors.New("RabbitMQ connection is closed")
+
+func (s ConnectionState) String() string {
+	switch s {
+	case StateConnecting:
+		return "connecting"
+	case StateConnected:
+		return "connected"
+	case StateReconnecting:
+		return "reconnecting"
+	case StateClosed:
+		return "closed"
+	default:
+		return "unknown"
+	}
+}
+
+// State returns the current connection state.
+func (r *RabbitMq) State() ConnectionState {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.state
+}
+
+// NotifyState registers a listener for connection state transitions.
+// Transitions are delivered without blocking, so the channel should be buffered.
+// The channel is closed once the connection reaches StateClosed.
+func (r *RabbitMq) NotifyState(c chan ConnectionState) chan ConnectionState {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.state == StateClosed {
+		close(c)
+		return c
+	}
+	r.stateSubs = append(r.stateSubs, c)
+	return c
+}
+
+// setStateLocked must be called with r.mutex held for writing.
+func (r *RabbitMq) setStateLocked(state ConnectionState) {
+	if r.state == state {
+		return
+	}
+	r.state = state
+	close(r.changed)
+	r.changed = make(chan struct{})
+
+	for _, sub := range r.stateSubs {
+		select {
+		case sub <- state:
+		default:
+		}
+		if state == StateClosed {
+			close(sub)
+		}
+	}
+	if state == StateClosed {
+		r.stateSubs = nil
+	}
+}
+
+func (r *RabbitMq) setState(state ConnectionState) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.setStateLocked(state)
+}
+
+// dial opens the publish and consume connections, re-using each one that is
+// still alive, declares the topology on a control channel and starts
+// watching all three for closure. Both connections are dialled from one
+// candidate list, preferring the node of the other connection.
+func (r *RabbitMq) dial() (err error) {
+	r.mutex.RLock()
+	conn, consumeConn, node, consumeNode, pool, oldCh := r.conn, r.consumeConn, r.node, r.consumeNode, r.pool, r.ch
+	r.mutex.RUnlock()
+	candidates := r.endpoints.candidates()
+
+	var fresh []*amqp091.Connection
+	defer func() {
+		if err != nil {
+			for _, c := range fresh {
+				_ = c.Close()
+			}
+		}
+	}()
+
+	if conn == nil || conn.IsClosed() {
+		urls := candidates
+		if consumeConn != nil && !consumeConn.IsClosed() {
+			urls = preferNode(candidates, consumeNode)
+		}
+		c, n, err := r.dialEndpoints(urls)
+		if err != nil {
+			return err
+		}
+		conn, node = c, n
+		fresh = append(fresh, conn)
+		pool = newChannelPool(r, conn, config.GetConfig().RabbitMQ.PublishChannels)
+		go r.watchBlocked(conn, conn.NotifyBlocked(make(chan amqp091.Blocking, 1)))
+	}
+
+	// Consumers get their own connection, so flow control applied to
+	// publishers does not hold up acks and deliveries
+	if consumeConn == nil || consumeConn.IsClosed() {
+		c, n, err := r.dialEndpoints(preferNode(candidates, node))
+		if err != nil {
+			return err
+		}
+		consumeConn, consumeNode = c, n
+		fresh = append(fresh, consumeConn)
+	}
+
+	ch, err := conn.Channel()
+	if err != nil {
+		loggers.Zap.Errorf("RabbitMQ Error: %s", err.Error())
+		return err
+	}
+	go r.watchFlow(ch, ch.NotifyFlow(make(chan bool, 1)))
+
+	if err := declareTopology(ch, config.GetConfig().RabbitMQ.Topology); err != nil {
+		loggers.Zap.Errorf("RabbitMQ Error: %s", err.Error())
+		_ = ch.Close()
+		return err
+	}
+
+	r.mutex.RLock()
+	declared := r.declared
+	r.mutex.RUnlock()
+	for _, topology := range declared {
+		if err := declareTopology(ch, topology); err != nil {
+			loggers.Zap.Errorf("RabbitMQ Error: %s", err.Error())
+			_ = ch.Close()
+			return err
+		}
+	}
+
+	if err := declareRetryTopology(ch); err != nil {
+		loggers.Zap.Errorf("RabbitMQ Error: %s", err.Error())
+		_ = ch.Close()
+		return err
+	}
+
+	r.mutex.Lock()
+	if r.state == StateClosed {
+		r.mutex.Unlock()
+		_ = ch.Close()
+		_ = conn.Close()
+		_ = consumeConn.Close()
+		return backoff.Permanent(ErrConnectionClosed)
+	}
+	r.conn = conn
+	r.consumeConn = consumeConn
+	r.ch = ch
+	r.pool = pool
+	r.node = node
+	r.consumeNode = consumeNode
+	r.setStateLocked(StateConnected)
+	r.mutex.Unlock()
+
+	// The control channel of a publish connection that survived a consume
+	// connection failure is replaced, stopping its watchFlow goroutine
+	if oldCh != nil && oldCh != ch && !oldCh.IsClosed() {
+		_ = oldCh.Close()
+	}
+
+	go r.watch(conn, consumeConn, ch)
+	return nil
+}
+
+// watch blocks until either connection or the control channel is closed and
+// triggers a reconnect unless the closure was requested through Shutdown.
+// Consumer and pooled channels are not watched: a channel-level error only
+// affects the consumer or publish that caused it.
+func (r *RabbitMq) watch(conn, consumeConn *amqp091.Connection, ch *amqp091.Channel) {
+	connClosed := conn.NotifyClose(make(chan *amqp091.Error, 1))
+	consumeConnClosed := consumeConn.NotifyClose(make(chan *amqp091.Error, 1))
+	chClosed := ch.NotifyClose(make(chan *amqp091.Error, 1))
+
+	var reason *amqp091.Error
+	select {
+	case reason = <-connClosed:
+	case reason = <-consumeConnClosed:
+	case reason = <-chClosed:
+	}
+	if r.State() == StateClosed {
+		return
+	}
+	if reason != nil {
+		loggers.Zap.Errorf("RabbitMQ connection lost: %s", reason.Error())
+	}
+	r.reconnect()
+}
+
+// reconnect keeps dialling with the configured backoff, ignoring
+// max_elapsed_time, until it succeeds, Shutdown is called or the global
+// context is cancelled. Giving up leaves the state at StateReconnecting, so
+// consumers keep waiting instead of treating an outage as a shutdown.
+func (r *RabbitMq) reconnect() {
+	r.setState(StateReconnecting)
+	log.Println("Reconnecting to RabbitMQ")
+
+	cfg := config.GetConfig().Backoff
+	err := utils.RetryOperation(func() error {
+		if r.State() == StateClosed {
+			return backoff.Permanent(ErrConnectionClosed)
+		}
+		return r.dial()
+	},
+		utils.WithInitialInterval(time.Second*time.Duration(cfg.InitialInterval)),
+		utils.WithRandomizationFactor(backoff.DefaultRandomizationFactor),
+		utils.WithMultiplier(cfg.Mulltiplier),
+		utils.WithMaxInterval(time.Second*time.Duration(cfg.MaxInterval)),
+		utils.WithMaxElapsedTime(0),
+		utils.WithRetryStopDuration(backoff.Stop),
+	)
+	if err != nil {
+		if r.State() != StateClosed {
+			loggers.Zap.Errorf("RabbitMQ reconnect stopped: %s", err.Error())
+		}
+		return
+	}
+	log.Printf("Reconnected to RabbitMQ node %s", r.Node())
+}
+
+// channelPool returns the publish channel pool or an error if the publish
+// connection is not usable.
+func (r *RabbitMq) channelPool() (*channelPool, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	if r.state != StateConnected || r.pool == nil || r.pool.conn.IsClosed() {
+		return nil, ErrConnectionClosed
+	}
+	return r.pool, nil
+}
+
+// connection returns the current publish connection or an error if it is not usable.
+func (r *RabbitMq) connection() (*amqp091.Connection, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	if r.state != StateConnected || r.conn == nil || r.conn.IsClosed() {
+		return nil, ErrConnectionClosed
+	}
+	return r.conn, nil
+}
+
+// consumerChannel blocks until a channel can be opened on the consume
+// connection. Every consumer gets a channel of its own.
+func (r *RabbitMq) consumerChannel(ctx context.Context) (*amqp091.Channel, error) {
+	for {
+		r.mutex.RLock()
+		conn, state, changed := r.consumeConn, r.state, r.changed
+		r.mutex.RUnlock()
+
+		if state == StateClosed {
+			return nil, ErrConnectionClosed
+		}
+		if state == StateConnected && !conn.IsClosed() {
+			ch, err := conn.Channel()
+			if err == nil {
+				return ch, nil
+			}
+			loggers.Zap.Errorf("RabbitMQ Error: %s", err.Error())
+			if !conn.IsClosed() {
+				// The connection is fine but refuses channels, e.g. at channel_max
+				select {
+				case <-ctx.Done():
+					return nil, ctx.Err()
+				case <-changed:
+				case <-time.After(consumerReopenDelay):
+				}
+				continue
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-changed:
+		}
+	}
+}
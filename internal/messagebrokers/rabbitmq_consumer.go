@@ -0,0 +1,299 @@
+package messagebrokers
+
+import (
+	"context"
+	"github.com/Roh-Bot/rabbitmq-pub-sub/internal/config"
+	"github.com/Roh-Bot/rabbitmq-pub-sub/internal/db"
+	"github.com/Roh-Bot/rabbitmq-pub-sub/internal/db/functions"
+	"github.com/Roh-Bot/rabbitmq-pub-sub/pkg/global"
+	"github.com/Roh-Bot/rabbitmq-pub-sub/pkg/loggers"
+	"github.com/rabbitmq/amqp091-go"
+	"log"
+	"sync"
+	"time"
+)
+
+// Acknowledgement tells the consumer how to settle a delivery once the
+// handler returns. It is ignored when the consumer runs with auto-ack.
+type Acknowledgement int
+
+const (
+	// Ack removes the message from the queue.
+	Ack Acknowledgement = iota
+	// Requeue puts the message back on the queue for immediate redelivery.
+	Requeue
+	// Drop rejects the message without requeueing it. With retries enabled
+	// the message is dead-lettered to the parking-lot queue.
+	Drop
+	// Retry redelivers the message after the delay of the next retry tier and
+	// parks it once rabbitmq.retry.max_attempts is exceeded. Without retries
+	// configured it behaves like Requeue.
+	Retry
+)
+
+func (a Acknowledgement) String() string {
+	switch a {
+	case Ack:
+		return "ack"
+	case Requeue:
+		return "requeue"
+	case Drop:
+		return "drop"
+	case Retry:
+		return "retry"
+	default:
+		return "unknown"
+	}
+}
+
+// DeliveryHandler processes a single delivery.
+type DeliveryHandler func(ctx context.Context, deliver amqp091.Delivery) Acknowledgement
+
+// Binding subscribes a consumer queue to an exchange. RoutingKey may be a
+// topic pattern such as orders.*.created; Headers are matched by headers exchanges.
+type Binding struct {
+	Exchange   string
+	RoutingKey string
+	Headers    amqp091.Table
+}
+
+// ErrorHandler is notified about deliveries that could not be handed to a handler.
+type ErrorHandler func(ctx context.Context, deliver amqp091.Delivery, err error)
+
+type consumerOptions struct {
+	autoAck       bool
+	prefetchCount int
+	bindings      []Binding
+	errorHandler  ErrorHandler
+	queue         string
+	middlewares   []Middleware
+}
+
+type ConsumerOption func(*consumerOptions)
+
+// WithAutoAck lets the broker consider messages acknowledged as soon as they are delivered.
+func WithAutoAck(autoAck bool) ConsumerOption {
+	return func(o *consumerOptions) {
+		o.autoAck = autoAck
+	}
+}
+
+// WithPrefetchCount limits the number of unacknowledged messages held by the consumer.
+func WithPrefetchCount(count int) ConsumerOption {
+	return func(o *consumerOptions) {
+		o.prefetchCount = count
+	}
+}
+
+// WithBindings binds the consumer queue with the given routing information
+// every time it is declared. Without bindings a generated queue is bound to
+// the configured exchange with an empty routing key.
+func WithBindings(bindings ...Binding) ConsumerOption {
+	return func(o *consumerOptions) {
+		o.bindings = append(o.bindings, bindings...)
+	}
+}
+
+// WithQueue consumes from a named, durable queue shared by all consumers
+// using the same name instead of a generated exclusive one. Named queues are
+// only bound through WithBindings.
+func WithQueue(name string) ConsumerOption {
+	return func(o *consumerOptions) {
+		o.queue = name
+	}
+}
+
+// WithMiddleware wraps the consumer's handler with middlewares, the first
+// being the outermost.
+func WithMiddleware(middlewares ...Middleware) ConsumerOption {
+	return func(o *consumerOptions) {
+		o.middlewares = append(o.middlewares, middlewares...)
+	}
+}
+
+// WithErrorHandler replaces the default handler, which logs, for deliveries
+// that fail to decompress or decode.
+func WithErrorHandler(handler ErrorHandler) ConsumerOption {
+	return func(o *consumerOptions) {
+		o.errorHandler = handler
+	}
+}
+
+func newConsumerOptions(opts []ConsumerOption) *consumerOptions {
+	o := &consumerOptions{
+		autoAck:       config.GetConfig().RabbitMQ.Consumer.AutoAck,
+		prefetchCount: config.GetConfig().RabbitMQ.Consumer.PrefetchCount,
+		errorHandler:  logDeliveryError,
+	}
+	for _, fn := range opts {
+		fn(o)
+	}
+	return o
+}
+
+func logDeliveryError(_ context.Context, deliver amqp091.Delivery, err error) {
+	loggers.Zap.Errorf("RabbitMQ Error: message %s on %s: %s", deliver.MessageId, deliver.RoutingKey, err.Error())
+}
+
+// Consume consumes from a freshly generated queue, or the one given with
+// WithQueue, until the global context is
+// cancelled, settling every delivery according to the handler's result.
+// Defaults come from the rabbitmq.consumer configuration section. When the
+// connection or channel is lost the queue is re-declared and the consumer
+// re-registered once the connection recovers.
+func (r *RabbitMq) Consume(wg *sync.WaitGroup, handler Handler, opts ...ConsumerOption) {
+	defer wg.Done()
+
+	o := newConsumerOptions(opts)
+	handler = Chain(handler, o.middlewares...)
+
+	if r.State() == StateClosed {
+		log.Println("RabbitMQ connection is already closed")
+		return
+	}
+
+	queueName := o.queue
+	if queueName == "" {
+		if err := db.PGReadSingleRow(&queueName, functions.GenerateAndGetQueueName); err != nil {
+			log.Println(err)
+			return
+		}
+
+		defer func() {
+			log.Printf("Deleting queue: %s\n", queueName)
+			if err := db.Postgres().ExecNonQuery(functions.DeleteQueue, queueName); err != nil {
+				loggers.Zap.Errorf("PG Error: %s", err.Error())
+				return
+			}
+		}()
+	}
+
+	ctx := global.CancellationContext()
+	for {
+		ch, err := r.consumerChannel(ctx)
+		if err != nil {
+			log.Printf("RabbitMQ receiver for queue %s stopped: %s", queueName, err)
+			return
+		}
+
+		msgs, err := r.consume(ch, queueName, o)
+		if err != nil {
+			loggers.Zap.Errorf("RabbitMQ Error: %s", err.Error())
+			_ = ch.Close()
+			select {
+			case <-ctx.Done():
+				log.Printf("RabbitMQ receiver for queue %s stopped: %s", queueName, ctx.Err())
+				return
+			case <-time.After(consumerReopenDelay):
+			}
+			continue
+		}
+
+		log.Printf(" [*] Waiting for messages from queue: %s. To exit press CTRL+C", queueName)
+		done := !receive(queueName, msgs, handler, o, r.retry)
+		_ = ch.Close()
+		if done {
+			break
+		}
+		log.Printf("Receiver channel for queue %s has been closed. Reopening...", queueName)
+	}
+	log.Printf("RabbitMQ receiver for queue %s stopped", queueName)
+}
+
+func (r *RabbitMq) consume(ch *amqp091.Channel, queueName string, o *consumerOptions) (<-chan amqp091.Delivery, error) {
+	named := o.queue != ""
+	q, err := ch.QueueDeclare(
+		queueName, // name
+		named,     // durable
+		false,     // delete when unused
+		!named,    // exclusive
+		false,     // no-wait
+		consumerQueueArgs(),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	bindings := o.bindings
+	if len(bindings) == 0 && !named {
+		bindings = []Binding{{Exchange: config.GetConfig().RabbitMQ.Exchange}}
+	}
+	for _, b := range bindings {
+		exchange := b.Exchange
+		if exchange == "" {
+			exchange = config.GetConfig().RabbitMQ.Exchange
+		}
+		if err := ch.QueueBind(q.Name, b.RoutingKey, exchange, false, b.Headers); err != nil {
+			return nil, err
+		}
+	}
+
+	// The channel is the consumer's own, so the prefetch only applies to it
+	if !o.autoAck && o.prefetchCount > 0 {
+		if err := ch.Qos(o.prefetchCount, 0, false); err != nil {
+			return nil, err
+		}
+	}
+	return ch.Consume(
+		q.Name,    // queue
+		"",        // consumer
+		o.autoAck, // auto-ack
+		false,     // exclusive
+		false,     // no-local
+		false,     // no-wait
+		nil,
+	)
+}
+
+// retryFunc schedules a delivery whose handler asked for a Retry.
+type retryFunc func(ctx context.Context, queueName string, deliver amqp091.Delivery) error
+
+// receive dispatches deliveries until msgs is closed, returning true, or the
+// global context is cancelled, returning false. It is shared by every backend
+// whose deliveries carry an Acknowledger.
+func receive(queueName string, msgs <-chan amqp091.Delivery, handler Handler, o *consumerOptions, retry retryFunc) bool {
+	ctx := global.CancellationContext()
+	for {
+		select {
+		case <-ctx.Done():
+			log.Println("Exiting RabbitMQ receiver...")
+			return false
+		case deliver, ok := <-msgs:
+			if !ok {
+				return true
+			}
+
+			var ack Acknowledgement
+			if body, err := decompress(deliver.ContentEncoding, deliver.Body); err != nil {
+				o.errorHandler(ctx, deliver, err)
+				ack = Drop
+			} else {
+				deliver.Body, deliver.ContentEncoding = body, ""
+				ack = handler.Handle(ctx, deliver)
+			}
+			if o.autoAck {
+				break
+			}
+			if ack == Retry {
+				if err := retry(ctx, queueName, deliver); err != nil {
+					loggers.Zap.Errorf("RabbitMQ Error: %s", err.Error())
+				}
+				break
+			}
+			if err := settle(deliver, ack); err != nil {
+				loggers.Zap.Errorf("RabbitMQ Error: %s", err.Error())
+			}
+		}
+	}
+}
+
+func settle(deliver amqp091.Delivery, ack Acknowledgement) error {
+	switch ack {
+	case Requeue:
+		return deliver.Nack(false, true)
+	case Drop:
+		return deliver.Reject(false)
+	default:
+		return deliver.Ack(false)
+	}
+}
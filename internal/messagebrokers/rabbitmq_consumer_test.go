@@ -0,0 +1,20 @@
+package messagebrokers
+
+import (
+	"github.com/rabbitmq/amqp091-go"
+	"reflect"
+	"testing"
+)
+
+func TestWithBindings(t *testing.T) {
+	orders := Binding{Exchange: "events", RoutingKey: "orders.#"}
+	eu := Binding{Exchange: "regions", Headers: amqp091.Table{"x-match": "all", "region": "eu"}}
+
+	if o := newConsumerOptions(nil); len(o.bindings) != 0 {
+		t.Errorf("bindings without WithBindings = %v", o.bindings)
+	}
+	o := newConsumerOptions([]ConsumerOption{WithBindings(orders), WithBindings(eu)})
+	if want := []Binding{orders, eu}; !reflect.DeepEqual(o.bindings, want) {
+		t.Errorf("bindings = %+v, want %+v", o.bindings, want)
+	}
+}
@@ -0,0 +1,142 @@
+package messagebrokers
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"github.com/Roh-Bot/rabbitmq-pub-sub/internal/config"
+	"github.com/rabbitmq/amqp091-go"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultHeartbeat = 10 * time.Second
+	defaultLocale    = "en_US"
+
+	AuthPlain    = "plain"
+	AuthExternal = "external"
+)
+
+var ErrInvalidCABundle = errors.New("RabbitMQ TLS CA bundle contains no certificates")
+
+// dialURL returns rabbitmq.url, or builds one from the host, credentials and
+// vhost, using amqps when TLS is enabled. A non-empty endpoint replaces the
+// configured host and port.
+func dialURL(endpoint string) string {
+	cfg := config.GetConfig().RabbitMQ
+	if cfg.URL != "" {
+		if endpoint == "" {
+			return cfg.URL
+		}
+		u, err := url.Parse(cfg.URL)
+		if err != nil {
+			return cfg.URL
+		}
+		u.Host = endpoint
+		return u.String()
+	}
+
+	if endpoint == "" {
+		endpoint = net.JoinHostPort(cfg.Host, strconv.Itoa(cfg.Port))
+	}
+	u := url.URL{
+		Scheme: "amqp",
+		Host:   endpoint,
+		Path:   "/",
+	}
+	if cfg.TLS.Enabled {
+		u.Scheme = "amqps"
+	}
+	if !strings.EqualFold(cfg.Auth, AuthExternal) {
+		u.User = url.UserPassword(cfg.User, cfg.Password)
+	}
+	if cfg.Vhost != "" && cfg.Vhost != "/" {
+		u.Path += cfg.Vhost
+	}
+	return u.String()
+}
+
+// dialConfig builds the connection settings from the rabbitmq section. Values
+// left at zero fall back to the URL or the broker's defaults.
+func dialConfig() (amqp091.Config, error) {
+	cfg := config.GetConfig().RabbitMQ
+
+	c := amqp091.Config{
+		ChannelMax: uint16(cfg.ChannelMax),
+		FrameSize:  cfg.FrameSize,
+		Heartbeat:  time.Duration(cfg.Heartbeat) * time.Second,
+		Properties: amqp091.NewConnectionProperties(),
+		Locale:     defaultLocale,
+	}
+	// A vhost given in rabbitmq.url wins over rabbitmq.vhost
+	if cfg.URL == "" {
+		c.Vhost = cfg.Vhost
+	}
+	if c.Heartbeat <= 0 {
+		c.Heartbeat = defaultHeartbeat
+	}
+	name := cfg.ConnectionName
+	if name == "" {
+		name = cfg.AppId
+	}
+	if name != "" {
+		c.Properties.SetClientConnectionName(name)
+	}
+
+	switch strings.ToLower(cfg.Auth) {
+	case "", AuthPlain:
+	case AuthExternal:
+		c.SASL = []amqp091.Authentication{&amqp091.ExternalAuth{}}
+	default:
+		return c, fmt.Errorf("unsupported RabbitMQ auth mechanism %q", cfg.Auth)
+	}
+
+	// Without rabbitmq.tls, amqps URLs configure TLS through their query parameters
+	if cfg.TLS.Enabled {
+		tlsConfig, err := tlsConfig()
+		if err != nil {
+			return c, err
+		}
+		c.TLSClientConfig = tlsConfig
+	}
+	return c, nil
+}
+
+// tlsConfig loads the CA bundle and client certificate named in rabbitmq.tls.
+// The system roots are used when no CA bundle is configured, and the server
+// name defaults to the host of each dialled endpoint.
+func tlsConfig() (*tls.Config, error) {
+	cfg := config.GetConfig().RabbitMQ.TLS
+
+	c := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         cfg.ServerName,
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+	}
+
+	if cfg.CAFile != "" {
+		pem, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading RabbitMQ CA bundle: %w", err)
+		}
+		c.RootCAs = x509.NewCertPool()
+		if !c.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, ErrInvalidCABundle
+		}
+	}
+
+	if cfg.CertFile != "" || cfg.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading RabbitMQ client certificate: %w", err)
+		}
+		c.Certificates = []tls.Certificate{cert}
+	}
+	return c, nil
+}
@@ -0,0 +1,142 @@
+package messagebrokers
+
+import (
+	"errors"
+	"fmt"
+	"github.com/Roh-Bot/rabbitmq-pub-sub/internal/config"
+	"github.com/Roh-Bot/rabbitmq-pub-sub/pkg/loggers"
+	"github.com/rabbitmq/amqp091-go"
+	"math/rand"
+	"strings"
+	"sync"
+)
+
+const (
+	StrategyOrdered    = "ordered"
+	StrategyRandom     = "random"
+	StrategyRoundRobin = "round_robin"
+)
+
+// endpointPool decides in which order the broker nodes are dialled.
+type endpointPool struct {
+	urls     []string
+	strategy string
+	next     int
+	mutex    *sync.Mutex
+}
+
+// newEndpointPool builds one URL per rabbitmq.endpoints entry, or a single
+// one from the host and port when no endpoints are configured.
+func newEndpointPool() (*endpointPool, error) {
+	cfg := config.GetConfig().RabbitMQ
+
+	p := &endpointPool{
+		strategy: strings.ToLower(cfg.EndpointStrategy),
+		mutex:    new(sync.Mutex),
+	}
+	switch p.strategy {
+	case "":
+		p.strategy = StrategyOrdered
+	case StrategyOrdered, StrategyRandom, StrategyRoundRobin:
+	default:
+		return nil, fmt.Errorf("unsupported RabbitMQ endpoint strategy %q", cfg.EndpointStrategy)
+	}
+
+	for _, endpoint := range cfg.Endpoints {
+		p.urls = append(p.urls, dialURL(endpoint))
+	}
+	if len(p.urls) == 0 {
+		p.urls = []string{dialURL("")}
+	}
+	return p, nil
+}
+
+// candidates returns every URL in the order the next dial should try them.
+// Ordered always prefers the first endpoint, round-robin starts one further
+// on every call and random shuffles them.
+func (p *endpointPool) candidates() []string {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	urls := make([]string, 0, len(p.urls))
+	switch p.strategy {
+	case StrategyRandom:
+		for _, i := range rand.Perm(len(p.urls)) {
+			urls = append(urls, p.urls[i])
+		}
+	case StrategyRoundRobin:
+		urls = append(urls, p.urls[p.next:]...)
+		urls = append(urls, p.urls[:p.next]...)
+		p.next = (p.next + 1) % len(p.urls)
+	default:
+		urls = append(urls, p.urls...)
+	}
+	return urls
+}
+
+// endpointNode returns the host and port of the node an endpoint URL points to.
+func endpointNode(u string) string {
+	if uri, err := amqp091.ParseURI(u); err == nil {
+		return fmt.Sprintf("%s:%d", uri.Host, uri.Port)
+	}
+	return u
+}
+
+// preferNode moves the URL of node to the front of urls, so a connection
+// dialled next to a live one lands on the same node when it can.
+func preferNode(urls []string, node string) []string {
+	for i, u := range urls {
+		if endpointNode(u) == node {
+			preferred := append([]string{u}, urls[:i]...)
+			return append(preferred, urls[i+1:]...)
+		}
+	}
+	return urls
+}
+
+// dialEndpoints connects to the first of urls that accepts the connection
+// and returns it together with the node's host and port.
+func (r *RabbitMq) dialEndpoints(urls []string) (*amqp091.Connection, string, error) {
+	var errs []error
+	for _, u := range urls {
+		node := endpointNode(u)
+
+		// DialConfig fills in the TLS server name per host, so every dial gets its own copy
+		c := r.dialConfig
+		if c.TLSClientConfig != nil {
+			c.TLSClientConfig = c.TLSClientConfig.Clone()
+		}
+
+		conn, err := amqp091.DialConfig(u, c)
+		if err != nil {
+			loggers.Zap.Errorf("RabbitMQ Error: dialling %s: %s", node, err.Error())
+			errs = append(errs, fmt.Errorf("%s: %w", node, err))
+			continue
+		}
+		return conn, node, nil
+	}
+	return nil, "", errors.Join(errs...)
+}
+
+// Node returns the host and port of the broker node the publish connection
+// is connected to, or an empty string while disconnected.
+func (r *RabbitMq) Node() string {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	if r.state != StateConnected {
+		return ""
+	}
+	return r.node
+}
+
+// ConsumeNode returns the host and port of the broker node the consume
+// connection is connected to, or an empty string while disconnected. It
+// differs from Node only when the two connections failed over separately.
+func (r *RabbitMq) ConsumeNode() string {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	if r.state != StateConnected {
+		return ""
+	}
+	return r.consumeNode
+}
@@ -0,0 +1,293 @@
+package messagebrokers
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/Roh-Bot/rabbitmq-pub-sub/internal/config"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// fakeNode is a TCP stand-in for a broker node. It completes the AMQP
+// connection handshake with PLAIN auth and answers connection.close, which
+// is all dialEndpoints needs.
+type fakeNode struct {
+	listener net.Listener
+	accepted atomic.Int32
+}
+
+func newFakeNode(t *testing.T) *fakeNode {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := &fakeNode{listener: listener}
+	t.Cleanup(func() { _ = listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			n.accepted.Add(1)
+			go n.serve(conn)
+		}
+	}()
+	return n
+}
+
+func (n *fakeNode) addr() string {
+	return n.listener.Addr().String()
+}
+
+// closedAddr returns the address of a port nothing listens on.
+func closedAddr(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	_ = listener.Close()
+	return addr
+}
+
+func (n *fakeNode) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(r, header); err != nil || !bytes.Equal(header, []byte("AMQP\x00\x00\x09\x01")) {
+		return
+	}
+
+	// connection.start: version 0-9, no server properties, PLAIN, en_US
+	start := method(10, 10)
+	start.Write([]byte{0, 9})
+	_ = binary.Write(start, binary.BigEndian, uint32(0))
+	longString(start, "PLAIN")
+	longString(start, "en_US")
+	if writeMethod(conn, start) != nil {
+		return
+	}
+
+	for {
+		class, id, err := readMethod(r)
+		if err != nil {
+			return
+		}
+		switch {
+		case class == 10 && id == 11:
+			// connection.start-ok, answered with connection.tune
+			tune := method(10, 30)
+			_ = binary.Write(tune, binary.BigEndian, uint16(0))
+			_ = binary.Write(tune, binary.BigEndian, uint32(131072))
+			_ = binary.Write(tune, binary.BigEndian, uint16(0))
+			err = writeMethod(conn, tune)
+		case class == 10 && id == 40:
+			// connection.open
+			openOk := method(10, 41)
+			openOk.WriteByte(0)
+			err = writeMethod(conn, openOk)
+		case class == 10 && id == 50:
+			// connection.close
+			_ = writeMethod(conn, method(10, 51))
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func method(class, id uint16) *bytes.Buffer {
+	b := new(bytes.Buffer)
+	_ = binary.Write(b, binary.BigEndian, class)
+	_ = binary.Write(b, binary.BigEndian, id)
+	return b
+}
+
+func longString(b *bytes.Buffer, s string) {
+	_ = binary.Write(b, binary.BigEndian, uint32(len(s)))
+	b.WriteString(s)
+}
+
+// writeMethod sends payload as a method frame on channel 0.
+func writeMethod(w io.Writer, payload *bytes.Buffer) error {
+	frame := []byte{1, 0, 0}
+	frame = binary.BigEndian.AppendUint32(frame, uint32(payload.Len()))
+	frame = append(frame, payload.Bytes()...)
+	frame = append(frame, 0xCE)
+	_, err := w.Write(frame)
+	return err
+}
+
+// readMethod returns the class and method id of the next method frame,
+// skipping heartbeats and any other frame type.
+func readMethod(r io.Reader) (uint16, uint16, error) {
+	for {
+		header := make([]byte, 7)
+		if _, err := io.ReadFull(r, header); err != nil {
+			return 0, 0, err
+		}
+		payload := make([]byte, binary.BigEndian.Uint32(header[3:])+1)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return 0, 0, err
+		}
+		if header[0] == 1 && len(payload) >= 5 {
+			return binary.BigEndian.Uint16(payload), binary.BigEndian.Uint16(payload[2:]), nil
+		}
+	}
+}
+
+func testEndpointPool(t *testing.T, strategy string, endpoints ...string) *endpointPool {
+	t.Helper()
+	setConfig(t, func(c *config.Configuration) {
+		c.RabbitMQ.Endpoints = endpoints
+		c.RabbitMQ.EndpointStrategy = strategy
+	})
+	p, err := newEndpointPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func nodesOf(urls []string) []string {
+	nodes := make([]string, len(urls))
+	for i, u := range urls {
+		nodes[i] = endpointNode(u)
+	}
+	return nodes
+}
+
+func TestEndpointPoolCandidates(t *testing.T) {
+	endpoints := []string{"node-1:5672", "node-2:5672", "node-3:5672"}
+
+	ordered := testEndpointPool(t, "", endpoints...)
+	for i := 0; i < 3; i++ {
+		if got := nodesOf(ordered.candidates()); !reflect.DeepEqual(got, endpoints) {
+			t.Fatalf("ordered call %d = %v, want %v", i, got, endpoints)
+		}
+	}
+
+	roundRobin := testEndpointPool(t, "ROUND_ROBIN", endpoints...)
+	for i, want := range [][]string{
+		{"node-1:5672", "node-2:5672", "node-3:5672"},
+		{"node-2:5672", "node-3:5672", "node-1:5672"},
+		{"node-3:5672", "node-1:5672", "node-2:5672"},
+		{"node-1:5672", "node-2:5672", "node-3:5672"},
+	} {
+		if got := nodesOf(roundRobin.candidates()); !reflect.DeepEqual(got, want) {
+			t.Fatalf("round_robin call %d = %v, want %v", i, got, want)
+		}
+	}
+
+	random := testEndpointPool(t, StrategyRandom, endpoints...)
+	orders := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		got := nodesOf(random.candidates())
+		seen := make(map[string]bool)
+		for _, node := range got {
+			seen[node] = true
+		}
+		if len(got) != len(endpoints) || len(seen) != len(endpoints) {
+			t.Fatalf("random call %d = %v, not a permutation of %v", i, got, endpoints)
+		}
+		orders[strings.Join(got, ",")] = true
+	}
+	if len(orders) < 2 {
+		t.Errorf("random produced the same order 100 times: %v", orders)
+	}
+
+	setConfig(t, func(c *config.Configuration) {
+		c.RabbitMQ.EndpointStrategy = "least_connections"
+	})
+	if _, err := newEndpointPool(); err == nil {
+		t.Error("newEndpointPool() with an unknown strategy succeeded")
+	}
+}
+
+func TestEndpointPoolWithoutEndpoints(t *testing.T) {
+	p := testEndpointPool(t, "")
+	if got, want := nodesOf(p.candidates()), []string{"127.0.0.1:5672"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("candidates() = %v, want %v", got, want)
+	}
+}
+
+func TestPreferNode(t *testing.T) {
+	urls := []string{"amqp://a:5672/", "amqp://b:5672/", "amqp://c:5672/"}
+	if got, want := preferNode(urls, "c:5672"), []string{"amqp://c:5672/", "amqp://a:5672/", "amqp://b:5672/"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("preferNode(c) = %v, want %v", got, want)
+	}
+	if got := preferNode(urls, "d:5672"); !reflect.DeepEqual(got, urls) {
+		t.Errorf("preferNode(d) = %v, want %v", got, urls)
+	}
+	if got, want := urls[0], "amqp://a:5672/"; got != want {
+		t.Errorf("preferNode modified its input: %v", urls)
+	}
+}
+
+func TestDialEndpointsSkipsUnreachableNodes(t *testing.T) {
+	closed := closedAddr(t)
+	live := newFakeNode(t)
+	other := newFakeNode(t)
+	p := testEndpointPool(t, StrategyOrdered, closed, live.addr(), other.addr())
+
+	c, err := dialConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &RabbitMq{dialConfig: c}
+
+	conn, node, err := r.dialEndpoints(p.candidates())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if node != live.addr() {
+		t.Errorf("connected to %s, want %s", node, live.addr())
+	}
+	if live.accepted.Load() != 1 || other.accepted.Load() != 0 {
+		t.Errorf("nodes accepted %d and %d connections, want 1 and 0", live.accepted.Load(), other.accepted.Load())
+	}
+
+	// Preferring a node dials it first
+	conn2, node2, err := r.dialEndpoints(preferNode(p.candidates(), other.addr()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn2.Close()
+	if node2 != other.addr() {
+		t.Errorf("connected to %s, want the preferred %s", node2, other.addr())
+	}
+}
+
+func TestDialEndpointsReportsEveryNode(t *testing.T) {
+	first, second := closedAddr(t), closedAddr(t)
+	p := testEndpointPool(t, StrategyOrdered, first, second)
+
+	c, err := dialConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &RabbitMq{dialConfig: c}
+
+	conn, node, err := r.dialEndpoints(p.candidates())
+	if err == nil {
+		_ = conn.Close()
+		t.Fatalf("connected to %s", node)
+	}
+	for _, addr := range []string{first, second} {
+		if !strings.Contains(err.Error(), fmt.Sprintf("%s:", addr)) {
+			t.Errorf("error %q does not name %s", err, addr)
+		}
+	}
+}
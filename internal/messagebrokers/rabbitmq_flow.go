@@ -0,0 +1,159 @@
+package messagebrokers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/Roh-Bot/rabbitmq-pub-sub/pkg/loggers"
+	"github.com/rabbitmq/amqp091-go"
+	"log"
+)
+
+var ErrPublishingPaused = errors.New("RabbitMQ publishing is paused by the broker")
+
+// ReturnHandler receives mandatory messages the broker could not route to any queue.
+type ReturnHandler func(ret amqp091.Return)
+
+// FlowControl describes whether the broker currently allows publishing.
+// Blocked is set while the connection is blocked, typically by a memory or
+// disk alarm, and FlowStopped while the broker has stopped channel flow.
+type FlowControl struct {
+	Blocked     bool
+	Reason      string
+	FlowStopped bool
+}
+
+// Paused reports whether publishing has to wait.
+func (f FlowControl) Paused() bool {
+	return f.Blocked || f.FlowStopped
+}
+
+// OnReturn sets the handler for returned mandatory messages. Without one,
+// returned messages are logged and discarded.
+func (r *RabbitMq) OnReturn(handler ReturnHandler) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.returnHandler = handler
+}
+
+// FlowControl returns the current flow control state.
+func (r *RabbitMq) FlowControl() FlowControl {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.flow
+}
+
+// NotifyFlowControl registers a listener for flow control changes. Changes are
+// delivered without blocking, so the channel should be buffered.
+func (r *RabbitMq) NotifyFlowControl(c chan FlowControl) chan FlowControl {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.flowSubs = append(r.flowSubs, c)
+	return c
+}
+
+// setFlowLocked must be called with r.mutex held for writing.
+func (r *RabbitMq) setFlowLocked(flow FlowControl) {
+	if r.flow == flow {
+		return
+	}
+	wasPaused := r.flow.Paused()
+	r.flow = flow
+
+	switch {
+	case flow.Paused() && !wasPaused:
+		r.unpaused = make(chan struct{})
+	case !flow.Paused() && wasPaused:
+		close(r.unpaused)
+	}
+
+	for _, sub := range r.flowSubs {
+		select {
+		case sub <- flow:
+		default:
+		}
+	}
+}
+
+// awaitUnpaused blocks while the broker does not allow publishing.
+func (r *RabbitMq) awaitUnpaused(ctx context.Context) error {
+	r.mutex.RLock()
+	unpaused := r.unpaused
+	r.mutex.RUnlock()
+
+	select {
+	case <-unpaused:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("%w: %w", ErrPublishingPaused, ctx.Err())
+	}
+}
+
+// watchBlocked tracks connection.blocked notifications until conn is closed.
+func (r *RabbitMq) watchBlocked(conn *amqp091.Connection, blocked <-chan amqp091.Blocking) {
+	for b := range blocked {
+		if b.Active {
+			log.Printf("RabbitMQ connection blocked: %s", b.Reason)
+		} else {
+			log.Println("RabbitMQ connection unblocked")
+		}
+		r.mutex.Lock()
+		if r.conn == conn || r.conn == nil {
+			flow := r.flow
+			flow.Blocked, flow.Reason = b.Active, b.Reason
+			r.setFlowLocked(flow)
+		}
+		r.mutex.Unlock()
+	}
+
+	// A new connection starts out unblocked
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.conn == conn {
+		flow := r.flow
+		flow.Blocked, flow.Reason = false, ""
+		r.setFlowLocked(flow)
+	}
+}
+
+// watchFlow tracks channel.flow notifications until ch is closed.
+func (r *RabbitMq) watchFlow(ch *amqp091.Channel, active <-chan bool) {
+	for a := range active {
+		if a {
+			log.Println("RabbitMQ channel flow resumed")
+		} else {
+			log.Println("RabbitMQ channel flow stopped")
+		}
+		r.mutex.Lock()
+		if r.ch == ch || r.ch == nil {
+			flow := r.flow
+			flow.FlowStopped = !a
+			r.setFlowLocked(flow)
+		}
+		r.mutex.Unlock()
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.ch == ch {
+		flow := r.flow
+		flow.FlowStopped = false
+		r.setFlowLocked(flow)
+	}
+}
+
+// watchReturns hands returned messages to the return handler until ch is closed.
+func (r *RabbitMq) watchReturns(returns <-chan amqp091.Return) {
+	for ret := range returns {
+		r.mutex.RLock()
+		handler := r.returnHandler
+		r.mutex.RUnlock()
+
+		if handler == nil {
+			loggers.Zap.Warnf("RabbitMQ returned message %s from %s/%s: %d %s",
+				ret.MessageId, ret.Exchange, ret.RoutingKey, ret.ReplyCode, ret.ReplyText)
+			continue
+		}
+		handler(ret)
+	}
+}
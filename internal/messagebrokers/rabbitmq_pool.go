@@ -0,0 +1,110 @@
+package messagebrokers
+
+import (
+	"context"
+	"github.com/rabbitmq/amqp091-go"
+)
+
+const defaultPublishChannels = 8
+
+// channelPool lends confirm-mode channels of the publish connection to
+// concurrent publishers. At most size channels are open at a time; closed
+// channels are discarded when they are taken or given back.
+type channelPool struct {
+	r    *RabbitMq
+	conn *amqp091.Connection
+	idle chan *amqp091.Channel
+	// slots holds a token for every open channel
+	slots chan struct{}
+}
+
+func newChannelPool(r *RabbitMq, conn *amqp091.Connection, size int) *channelPool {
+	if size <= 0 {
+		size = defaultPublishChannels
+	}
+	return &channelPool{
+		r:     r,
+		conn:  conn,
+		idle:  make(chan *amqp091.Channel, size),
+		slots: make(chan struct{}, size),
+	}
+}
+
+// acquire returns an idle channel, opens a new one while below the pool size,
+// or waits for a channel to be released.
+func (p *channelPool) acquire(ctx context.Context) (*amqp091.Channel, error) {
+	for {
+		select {
+		case ch := <-p.idle:
+			if p.healthy(ch) {
+				return ch, nil
+			}
+			continue
+		default:
+		}
+
+		select {
+		case ch := <-p.idle:
+			if p.healthy(ch) {
+				return ch, nil
+			}
+		case p.slots <- struct{}{}:
+			ch, err := p.open()
+			if err != nil {
+				<-p.slots
+				return nil, err
+			}
+			return ch, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// release gives ch back to the pool, or frees its slot if it was closed.
+func (p *channelPool) release(ch *amqp091.Channel) {
+	if !p.healthy(ch) {
+		return
+	}
+	p.idle <- ch
+}
+
+// healthy reports whether ch is still open, freeing its slot if it is not.
+func (p *channelPool) healthy(ch *amqp091.Channel) bool {
+	if ch.IsClosed() {
+		<-p.slots
+		return false
+	}
+	return true
+}
+
+func (p *channelPool) open() (*amqp091.Channel, error) {
+	if p.conn.IsClosed() {
+		return nil, ErrConnectionClosed
+	}
+	ch, err := p.conn.Channel()
+	if err != nil {
+		return nil, err
+	}
+	// Publisher confirms back the error-returning Publish API
+	if err := ch.Confirm(false); err != nil {
+		_ = ch.Close()
+		return nil, err
+	}
+	go p.r.watchReturns(ch.NotifyReturn(make(chan amqp091.Return, 16)))
+	return ch, nil
+}
+
+// close closes the idle channels. Channels still lent out are closed
+// together with the publish connection.
+func (p *channelPool) close() {
+	for {
+		select {
+		case ch := <-p.idle:
+			_ = ch.Close()
+			<-p.slots
+		default:
+			return
+		}
+	}
+}
@@ -0,0 +1,284 @@
+package messagebrokers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/Roh-Bot/rabbitmq-pub-sub/internal/config"
+	"github.com/Roh-Bot/rabbitmq-pub-sub/pkg/loggers"
+	"github.com/Roh-Bot/rabbitmq-pub-sub/pkg/utils"
+	"github.com/cenkalti/backoff/v4"
+	"github.com/rabbitmq/amqp091-go"
+	"time"
+)
+
+// defaultConfirmTimeout bounds a single publish attempt when
+// rabbitmq.confirm_timeout is not configured.
+const defaultConfirmTimeout = 5 * time.Second
+
+var (
+	ErrPublishNacked  = errors.New("RabbitMQ publish was nacked by the broker")
+	ErrPublishTimeout = errors.New("RabbitMQ publish confirmation timed out")
+)
+
+// PublishError is returned when a message could not be confirmed by the broker.
+// Err wraps one of ErrPublishNacked, ErrPublishTimeout, ErrPublishingPaused
+// or the underlying connection error.
+type PublishError struct {
+	Exchange string
+	Err      error
+}
+
+func (e *PublishError) Error() string {
+	return fmt.Sprintf("RabbitMQ publish to exchange %q failed: %s", e.Exchange, e.Err)
+}
+
+func (e *PublishError) Unwrap() error {
+	return e.Err
+}
+
+// PublishFuture is the pending result of PublishAsync.
+type PublishFuture struct {
+	done chan struct{}
+	err  error
+}
+
+// Done is closed once the publish has been confirmed or has failed.
+func (f *PublishFuture) Done() <-chan struct{} {
+	return f.done
+}
+
+// Err returns the publish result. It must only be called after Done is closed.
+func (f *PublishFuture) Err() error {
+	return f.err
+}
+
+// Wait blocks until the publish has completed and returns its result.
+func (f *PublishFuture) Wait() error {
+	<-f.done
+	return f.err
+}
+
+type publishOptions struct {
+	exchange      string
+	routingKey    string
+	headers       amqp091.Table
+	contentType   string
+	messageId     string
+	correlationId string
+	messageType   string
+	mandatory     bool
+	retryOpts     []utils.RetryOpts
+}
+
+type PublishOption func(*publishOptions)
+
+// WithExchange publishes to exchange instead of the configured rabbitmq.exchange.
+func WithExchange(exchange string) PublishOption {
+	return func(o *publishOptions) {
+		o.exchange = exchange
+	}
+}
+
+// WithRoutingKey sets the routing key used by direct and topic exchanges.
+func WithRoutingKey(key string) PublishOption {
+	return func(o *publishOptions) {
+		o.routingKey = key
+	}
+}
+
+// WithHeaders adds headers to the message, such as those matched by headers exchanges.
+func WithHeaders(headers amqp091.Table) PublishOption {
+	return func(o *publishOptions) {
+		for k, v := range headers {
+			o.headers[k] = v
+		}
+	}
+}
+
+// WithHeader adds a single header to the message.
+func WithHeader(key string, value any) PublishOption {
+	return func(o *publishOptions) {
+		o.headers[key] = value
+	}
+}
+
+// WithMessageId overrides the generated UUIDv7 message id.
+func WithMessageId(id string) PublishOption {
+	return func(o *publishOptions) {
+		if id != "" {
+			o.messageId = id
+		}
+	}
+}
+
+// WithCorrelationId links the message to a request or conversation.
+func WithCorrelationId(id string) PublishOption {
+	return func(o *publishOptions) {
+		o.correlationId = id
+	}
+}
+
+// WithMessageType overrides the schema type derived from the body's Go type.
+func WithMessageType(messageType string) PublishOption {
+	return func(o *publishOptions) {
+		if messageType != "" {
+			o.messageType = messageType
+		}
+	}
+}
+
+// WithContentType selects the codec used to encode the message. It defaults to
+// the content type configured for the exchange, falling back to JSON.
+func WithContentType(contentType string) PublishOption {
+	return func(o *publishOptions) {
+		o.contentType = contentType
+	}
+}
+
+// WithMandatory asks the broker to return the message to the ReturnHandler
+// set with OnReturn if it cannot be routed to any queue. It defaults to
+// rabbitmq.mandatory.
+func WithMandatory(mandatory bool) PublishOption {
+	return func(o *publishOptions) {
+		o.mandatory = mandatory
+	}
+}
+
+// WithRetry overrides the configured backoff settings for nacked or timed-out publishes.
+func WithRetry(retryOpts ...utils.RetryOpts) PublishOption {
+	return func(o *publishOptions) {
+		o.retryOpts = retryOpts
+	}
+}
+
+func newPublishOptions(opts []PublishOption) *publishOptions {
+	o := &publishOptions{
+		exchange:  config.GetConfig().RabbitMQ.Exchange,
+		headers:   amqp091.Table{},
+		mandatory: config.GetConfig().RabbitMQ.Mandatory,
+	}
+	for _, fn := range opts {
+		fn(o)
+	}
+	if o.contentType == "" {
+		o.contentType = exchangeContentType(o.exchange)
+	}
+	return o
+}
+
+// Publish sends body to the configured exchange and blocks until the broker
+// acks it or ctx expires. Nacked and timed-out attempts are retried using the
+// configured backoff settings unless WithRetry is given.
+func (r *RabbitMq) Publish(ctx context.Context, body any, opts ...PublishOption) error {
+	return r.publish(ctx, body, opts)
+}
+
+// publish encodes body and publishes it with confirms.
+func (r *RabbitMq) publish(ctx context.Context, body any, opts []PublishOption) error {
+	o, msg, err := preparePublishing(ctx, body, opts)
+	if err != nil {
+		return err
+	}
+
+	return utils.RetryOperation(func() error {
+		err := r.publishConfirmed(ctx, o.exchange, o.routingKey, o.mandatory, msg)
+		if err != nil && ctx.Err() != nil {
+			return backoff.Permanent(err)
+		}
+		if err != nil {
+			loggers.Zap.Warnf("RabbitMQ publish failed, retrying: %s", err.Error())
+		}
+		return err
+	}, o.retryOpts...)
+}
+
+// preparePublishing fills in the message properties of the standard
+// envelope and the trace parent of ctx, then encodes and compresses body.
+func preparePublishing(ctx context.Context, body any, opts []PublishOption) (*publishOptions, amqp091.Publishing, error) {
+	if traceParent := TraceParent(ctx); traceParent != "" {
+		opts = append([]PublishOption{WithHeader(HeaderTraceParent, traceParent)}, opts...)
+	}
+	o := newPublishOptions(append([]PublishOption{
+		WithMessageId(NewMessageId()),
+		WithMessageType(schemaType(body)),
+		WithHeader(HeaderInstanceId, instanceId),
+	}, opts...))
+
+	codec, err := CodecFor(o.contentType)
+	if err != nil {
+		return nil, amqp091.Publishing{}, err
+	}
+	bodyBytes, err := codec.Marshal(body)
+	if err != nil {
+		return nil, amqp091.Publishing{}, err
+	}
+	bodyBytes, encoding, err := compress(o.exchange, bodyBytes)
+	if err != nil {
+		return nil, amqp091.Publishing{}, err
+	}
+
+	msg := amqp091.Publishing{
+		Headers:         o.headers,
+		ContentType:     codec.ContentType(),
+		ContentEncoding: encoding,
+		MessageId:       o.messageId,
+		CorrelationId:   o.correlationId,
+		Timestamp:       time.Now().UTC(),
+		Type:            o.messageType,
+		AppId:           config.GetConfig().RabbitMQ.AppId,
+		Body:            bodyBytes,
+	}
+	return o, msg, nil
+}
+
+// PublishAsync is the non-blocking variant of Publish.
+func (r *RabbitMq) PublishAsync(ctx context.Context, body any, opts ...PublishOption) *PublishFuture {
+	f := &PublishFuture{done: make(chan struct{})}
+	go func() {
+		defer close(f.done)
+		f.err = r.Publish(ctx, body, opts...)
+	}()
+	return f
+}
+
+// publishConfirmed publishes a single message and waits for its confirmation.
+// The whole attempt, including waiting while the broker has paused
+// publishing, is bounded by the confirm timeout, so callers passing the
+// global context do not hang on a blocked connection.
+func (r *RabbitMq) publishConfirmed(ctx context.Context, exchange, key string, mandatory bool, msg amqp091.Publishing) error {
+	timeout := time.Duration(config.GetConfig().RabbitMQ.ConfirmTimeout) * time.Second
+	if timeout <= 0 {
+		timeout = defaultConfirmTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	if err := r.awaitUnpaused(ctx); err != nil {
+		return &PublishError{Exchange: exchange, Err: err}
+	}
+	pool, err := r.channelPool()
+	if err != nil {
+		return &PublishError{Exchange: exchange, Err: err}
+	}
+
+	ch, err := pool.acquire(ctx)
+	if err != nil {
+		return &PublishError{Exchange: exchange, Err: err}
+	}
+	defer pool.release(ch)
+
+	dc, err := ch.PublishWithDeferredConfirmWithContext(ctx, exchange, key, mandatory, false, msg)
+	if err != nil {
+		return &PublishError{Exchange: exchange, Err: err}
+	}
+
+	acked, err := dc.WaitContext(ctx)
+	if err != nil {
+		return &PublishError{Exchange: exchange, Err: fmt.Errorf("%w: %w", ErrPublishTimeout, err)}
+	}
+	if !acked {
+		return &PublishError{Exchange: exchange, Err: ErrPublishNacked}
+	}
+	return nil
+}
@@ -0,0 +1,36 @@
+package messagebrokers
+
+import (
+	"context"
+	"github.com/Roh-Bot/rabbitmq-pub-sub/internal/config"
+	"github.com/rabbitmq/amqp091-go"
+	"testing"
+)
+
+func TestPublishOptions(t *testing.T) {
+	setConfig(t, func(c *config.Configuration) {
+		c.RabbitMQ.Mandatory = true
+	})
+
+	o := newPublishOptions(nil)
+	if o.exchange != testExchange || o.routingKey != "" || !o.mandatory {
+		t.Errorf("defaults: exchange %q, routing key %q, mandatory %t", o.exchange, o.routingKey, o.mandatory)
+	}
+
+	o, msg, err := preparePublishing(context.Background(), map[string]any{"id": 1},
+		[]PublishOption{
+			WithExchange("orders"),
+			WithRoutingKey("orders.created"),
+			WithHeaders(amqp091.Table{"region": "eu", "tier": "gold"}),
+			WithHeaders(amqp091.Table{"tier": "silver"}),
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.exchange != "orders" || o.routingKey != "orders.created" {
+		t.Errorf("exchange %q, routing key %q", o.exchange, o.routingKey)
+	}
+	if msg.Headers["region"] != "eu" || msg.Headers["tier"] != "silver" {
+		t.Errorf("headers = %v, want region eu and the later tier silver", msg.Headers)
+	}
+}
@@ -0,0 +1,184 @@
+package messagebrokers
+
+import (
+	"context"
+	"fmt"
+	"github.com/Roh-Bot/rabbitmq-pub-sub/internal/config"
+	"github.com/rabbitmq/amqp091-go"
+	"math"
+	"strings"
+	"time"
+)
+
+// retryEnabled reports whether failed deliveries go through the retry tiers.
+func retryEnabled() bool {
+	return config.GetConfig().RabbitMQ.Retry.MaxAttempts > 0
+}
+
+// deadLetterExchange receives rejected messages and those that ran out of attempts.
+func deadLetterExchange() string {
+	return config.GetConfig().RabbitMQ.Exchange + ".dlx"
+}
+
+// parkingLotQueue holds dead-lettered messages for manual inspection.
+func parkingLotQueue() string {
+	return config.GetConfig().RabbitMQ.Exchange + ".parking-lot"
+}
+
+func retryPrefix() string {
+	return config.GetConfig().RabbitMQ.Exchange + ".retry."
+}
+
+// retryTierName names both the exchange and the queue of a retry tier.
+func retryTierName(delay time.Duration) string {
+	return fmt.Sprintf("%s%dms", retryPrefix(), delay.Milliseconds())
+}
+
+// retryTiers returns the configured retry delays. When no tiers are configured
+// they are derived from the backoff section, one tier per attempt.
+func retryTiers() []time.Duration {
+	cfg := config.GetConfig()
+	tiers := make([]time.Duration, 0, len(cfg.RabbitMQ.Retry.Tiers))
+	for _, t := range cfg.RabbitMQ.Retry.Tiers {
+		tiers = append(tiers, time.Duration(t)*time.Second)
+	}
+	if len(tiers) != 0 {
+		return tiers
+	}
+
+	initial := float64(cfg.Backoff.InitialInterval)
+	maxInterval := float64(cfg.Backoff.MaxInterval)
+	for i := 0; i < cfg.RabbitMQ.Retry.MaxAttempts; i++ {
+		delay := initial * math.Pow(cfg.Backoff.Mulltiplier, float64(i))
+		if maxInterval > 0 {
+			delay = math.Min(delay, maxInterval)
+		}
+		d := time.Duration(delay * float64(time.Second))
+		if len(tiers) != 0 && tiers[len(tiers)-1] == d {
+			break
+		}
+		tiers = append(tiers, d)
+	}
+	if len(tiers) == 0 {
+		tiers = append(tiers, time.Second)
+	}
+	return tiers
+}
+
+// declareRetryTopology declares the dead-letter exchange, the parking-lot
+// queue and one fanout exchange plus TTL queue per retry tier. Expired
+// messages are dead-lettered to the default exchange keeping their routing
+// key, which is the name of the queue they came from.
+func declareRetryTopology(ch *amqp091.Channel) error {
+	if !retryEnabled() {
+		return nil
+	}
+
+	if err := ch.ExchangeDeclare(deadLetterExchange(), amqp091.ExchangeFanout, true, false, false, false, nil); err != nil {
+		return err
+	}
+	if _, err := ch.QueueDeclare(parkingLotQueue(), true, false, false, false, nil); err != nil {
+		return err
+	}
+	if err := ch.QueueBind(parkingLotQueue(), "", deadLetterExchange(), false, nil); err != nil {
+		return err
+	}
+
+	for _, delay := range retryTiers() {
+		name := retryTierName(delay)
+		if err := ch.ExchangeDeclare(name, amqp091.ExchangeFanout, true, false, false, false, nil); err != nil {
+			return err
+		}
+		_, err := ch.QueueDeclare(name, true, false, false, false, amqp091.Table{
+			"x-message-ttl":          delay.Milliseconds(),
+			"x-dead-letter-exchange": "",
+		})
+		if err != nil {
+			return err
+		}
+		if err := ch.QueueBind(name, "", name, false, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// consumerQueueArgs routes messages rejected by a consumer to the dead-letter exchange.
+func consumerQueueArgs() amqp091.Table {
+	if !retryEnabled() {
+		return nil
+	}
+	return amqp091.Table{"x-dead-letter-exchange": deadLetterExchange()}
+}
+
+// nextRetryTier returns the delay of the retry tier the delivery goes through
+// next, or false once it has used up rabbitmq.retry.max_attempts.
+func nextRetryTier(deliver amqp091.Delivery) (time.Duration, bool) {
+	attempts := DeliveryAttempts(deliver)
+	if attempts >= config.GetConfig().RabbitMQ.Retry.MaxAttempts {
+		return 0, false
+	}
+	tiers := retryTiers()
+	return tiers[min(attempts, len(tiers)-1)], true
+}
+
+// DeliveryAttempts returns how many times the delivery has already been
+// through a retry tier, as recorded in its x-death header.
+func DeliveryAttempts(deliver amqp091.Delivery) int {
+	deaths, ok := deliver.Headers["x-death"].([]interface{})
+	if !ok {
+		return 0
+	}
+
+	attempts := 0
+	for _, d := range deaths {
+		death, ok := d.(amqp091.Table)
+		if !ok {
+			continue
+		}
+		queue, _ := death["queue"].(string)
+		if !strings.HasPrefix(queue, retryPrefix()) {
+			continue
+		}
+		if count, ok := death["count"].(int64); ok {
+			attempts += int(count)
+		}
+	}
+	return attempts
+}
+
+// retry republishes the delivery to the retry tier matching its attempt count
+// and acks the original. Deliveries that have exhausted their attempts are
+// rejected, which moves them to the parking-lot queue.
+func (r *RabbitMq) retry(ctx context.Context, queueName string, deliver amqp091.Delivery) error {
+	if !retryEnabled() {
+		return deliver.Nack(false, true)
+	}
+
+	tier, ok := nextRetryTier(deliver)
+	if !ok {
+		return deliver.Reject(false)
+	}
+
+	err := r.publishConfirmed(ctx, retryTierName(tier), queueName, false, amqp091.Publishing{
+		Headers:         deliver.Headers,
+		ContentType:     deliver.ContentType,
+		ContentEncoding: deliver.ContentEncoding,
+		DeliveryMode:    deliver.DeliveryMode,
+		Priority:        deliver.Priority,
+		CorrelationId:   deliver.CorrelationId,
+		ReplyTo:         deliver.ReplyTo,
+		MessageId:       deliver.MessageId,
+		Timestamp:       deliver.Timestamp,
+		Type:            deliver.Type,
+		AppId:           deliver.AppId,
+		Body:            deliver.Body,
+	})
+	if err != nil {
+		if nackErr := deliver.Nack(false, true); nackErr != nil {
+			return nackErr
+		}
+		return err
+	}
+	return deliver.Ack(false)
+}
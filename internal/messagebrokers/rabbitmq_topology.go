@@ -0,0 +1,128 @@
+package messagebrokers
+
+import (
+	"fmt"
+	"github.com/Roh-Bot/rabbitmq-pub-sub/internal/config"
+	"github.com/rabbitmq/amqp091-go"
+)
+
+// declareTopology declares the exchanges, queues and bindings from the
+// rabbitmq.topology section. Declarations are idempotent, so this runs on
+// every (re)connect before consumers are registered.
+func declareTopology(ch *amqp091.Channel, topology config.Topology) error {
+	for _, e := range topology.Exchanges {
+		kind := e.Type
+		if kind == "" {
+			kind = amqp091.ExchangeFanout
+		}
+		args := toTable(e.Arguments)
+		if e.AlternateExchange != "" {
+			if err := declareAlternateExchange(ch, e.AlternateExchange); err != nil {
+				return err
+			}
+			if args == nil {
+				args = amqp091.Table{}
+			}
+			args["alternate-exchange"] = e.AlternateExchange
+		}
+		if err := ch.ExchangeDeclare(e.Name, kind, e.Durable, e.AutoDelete, e.Internal, false, args); err != nil {
+			return fmt.Errorf("declaring exchange %s: %w", e.Name, err)
+		}
+	}
+
+	for _, q := range topology.Queues {
+		if _, err := ch.QueueDeclare(q.Name, q.Durable, q.AutoDelete, q.Exclusive, false, toTable(q.Arguments)); err != nil {
+			return fmt.Errorf("declaring queue %s: %w", q.Name, err)
+		}
+	}
+
+	for _, b := range topology.Bindings {
+		keys := b.RoutingKeys
+		if len(keys) == 0 {
+			keys = []string{""}
+		}
+		for _, key := range keys {
+			if err := ch.QueueBind(b.Queue, key, b.Exchange, false, toTable(b.Arguments)); err != nil {
+				return fmt.Errorf("binding queue %s to %s with key %q: %w", b.Queue, b.Exchange, key, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Declare declares topology in addition to rabbitmq.topology. It is declared
+// again on every reconnect.
+func (r *RabbitMq) Declare(topology config.Topology) error {
+	conn, err := r.connection()
+	if err != nil {
+		return err
+	}
+	ch, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = ch.Close()
+	}()
+
+	if err := declareTopology(ch, topology); err != nil {
+		return err
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.declared = append(r.declared, topology)
+	return nil
+}
+
+// declareAlternateExchange declares name as a fanout exchange with a queue of
+// the same name, so unroutable messages are kept for inspection.
+func declareAlternateExchange(ch *amqp091.Channel, name string) error {
+	if err := ch.ExchangeDeclare(name, amqp091.ExchangeFanout, true, false, false, false, nil); err != nil {
+		return fmt.Errorf("declaring alternate exchange %s: %w", name, err)
+	}
+	if _, err := ch.QueueDeclare(name, true, false, false, false, nil); err != nil {
+		return fmt.Errorf("declaring alternate exchange queue %s: %w", name, err)
+	}
+	if err := ch.QueueBind(name, "", name, false, nil); err != nil {
+		return fmt.Errorf("binding alternate exchange queue %s: %w", name, err)
+	}
+	return nil
+}
+
+// exchangeContentType returns the content type configured for exchange in the
+// topology, or an empty string if there is none.
+func exchangeContentType(exchange string) string {
+	for _, e := range config.GetConfig().RabbitMQ.Topology.Exchanges {
+		if e.Name == exchange {
+			return e.ContentType
+		}
+	}
+	return ""
+}
+
+// toTable converts configuration maps, including nested ones, into AMQP tables.
+func toTable(args map[string]any) amqp091.Table {
+	if len(args) == 0 {
+		return nil
+	}
+	table := make(amqp091.Table, len(args))
+	for k, v := range args {
+		table[k] = toField(v)
+	}
+	return table
+}
+
+func toField(v any) any {
+	switch fv := v.(type) {
+	case map[string]any:
+		return toTable(fv)
+	case []any:
+		fields := make([]any, len(fv))
+		for i, f := range fv {
+			fields[i] = toField(f)
+		}
+		return fields
+	default:
+		return v
+	}
+}
@@ -0,0 +1,142 @@
+package messagebrokers
+
+import (
+	"fmt"
+	"github.com/Roh-Bot/rabbitmq-pub-sub/internal/config"
+	"github.com/rabbitmq/amqp091-go"
+	"sync"
+)
+
+// routingTable records declared exchanges and the bindings of named queues
+// for backends that route messages on the consumer side.
+type routingTable struct {
+	mutex *sync.RWMutex
+	// exchanges maps declared exchanges to their type
+	exchanges map[string]string
+	// bindings holds the bindings declared for named queues
+	bindings map[string][]Binding
+}
+
+func newRoutingTable() *routingTable {
+	return &routingTable{
+		mutex:     new(sync.RWMutex),
+		exchanges: make(map[string]string),
+		bindings:  make(map[string][]Binding),
+	}
+}
+
+// declare records the exchanges and bindings of topology. Exchanges may be
+// fanout, direct or topic; re-declaring an exchange with another type fails.
+func (t *routingTable) declare(topology config.Topology) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for _, e := range topology.Exchanges {
+		kind := e.Type
+		if kind == "" {
+			kind = amqp091.ExchangeFanout
+		}
+		switch kind {
+		case amqp091.ExchangeFanout, amqp091.ExchangeDirect, amqp091.ExchangeTopic:
+		default:
+			return fmt.Errorf("declaring exchange %s: unsupported type %q", e.Name, kind)
+		}
+		if existing, ok := t.exchanges[e.Name]; ok && existing != kind {
+			return fmt.Errorf("declaring exchange %s: %w", e.Name, ErrExchangeTypeChanged)
+		}
+		t.exchanges[e.Name] = kind
+	}
+
+	for _, b := range topology.Bindings {
+		if _, ok := t.exchanges[b.Exchange]; !ok {
+			return fmt.Errorf("binding queue %s: %w: %s", b.Queue, ErrUnknownExchange, b.Exchange)
+		}
+		keys := b.RoutingKeys
+		if len(keys) == 0 {
+			keys = []string{""}
+		}
+		for _, key := range keys {
+			t.bindings[b.Queue] = append(t.bindings[b.Queue], Binding{Exchange: b.Exchange, RoutingKey: key})
+		}
+	}
+	return nil
+}
+
+// checkExchange fails for exchanges that were never declared. The default
+// exchange always exists.
+func (t *routingTable) checkExchange(exchange string) error {
+	if exchange == "" {
+		return nil
+	}
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	if _, ok := t.exchanges[exchange]; !ok {
+		return fmt.Errorf("%w: %s", ErrUnknownExchange, exchange)
+	}
+	return nil
+}
+
+// router returns the routing of a consumer of queue with the given bindings.
+// Like RabbitMq.Consume, a consumer without a named queue or bindings is
+// bound to the configured exchange.
+func (t *routingTable) router(queue string, named bool, bindings []Binding) *consumerRouter {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	r := &consumerRouter{
+		queue:     queue,
+		named:     named,
+		exchanges: make(map[string]string, len(t.exchanges)),
+	}
+	for name, kind := range t.exchanges {
+		r.exchanges[name] = kind
+	}
+
+	bindings = append(append([]Binding(nil), bindings...), t.bindings[queue]...)
+	if len(bindings) == 0 && !named {
+		bindings = []Binding{{}}
+	}
+	for _, b := range bindings {
+		if b.Exchange == "" {
+			b.Exchange = config.GetConfig().RabbitMQ.Exchange
+		}
+		r.bindings = append(r.bindings, b)
+	}
+	return r
+}
+
+// consumerRouter decides which messages a single consumer receives.
+type consumerRouter struct {
+	queue     string
+	named     bool
+	bindings  []Binding
+	exchanges map[string]string
+}
+
+// routes reports whether a message published to exchange with key reaches
+// the consumer. Named queues also receive messages sent to the default
+// exchange with the queue name as routing key.
+func (r *consumerRouter) routes(exchange, key string) bool {
+	if exchange == "" {
+		return r.named && key == r.queue
+	}
+	for _, b := range r.bindings {
+		if b.Exchange == exchange && exchangeRoutes(r.exchanges[exchange], b.RoutingKey, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// exchangeNames returns the exchanges the consumer is bound to.
+func (r *consumerRouter) exchangeNames() []string {
+	seen := make(map[string]bool)
+	names := make([]string, 0, len(r.bindings))
+	for _, b := range r.bindings {
+		if !seen[b.Exchange] {
+			seen[b.Exchange] = true
+			names = append(names, b.Exchange)
+		}
+	}
+	return names
+}
@@ -0,0 +1,95 @@
+package messagebrokers
+
+import (
+	"errors"
+	"github.com/Roh-Bot/rabbitmq-pub-sub/internal/config"
+	"reflect"
+	"testing"
+)
+
+func TestRoutingTableDeclare(t *testing.T) {
+	table := newRoutingTable()
+	err := table.declare(config.Topology{
+		Exchanges: []config.Exchange{{Name: "events", Type: "topic"}, {Name: "logs"}},
+		Bindings:  []config.Binding{{Exchange: "events", Queue: "audit", RoutingKeys: []string{"orders.#", "users.*"}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kind := table.exchanges["logs"]; kind != "fanout" {
+		t.Errorf("exchange without a type declared as %q, want fanout", kind)
+	}
+	want := []Binding{{Exchange: "events", RoutingKey: "orders.#"}, {Exchange: "events", RoutingKey: "users.*"}}
+	if got := table.bindings["audit"]; !reflect.DeepEqual(got, want) {
+		t.Errorf("bindings = %+v, want %+v", got, want)
+	}
+
+	if err := table.declare(config.Topology{Exchanges: []config.Exchange{{Name: "events", Type: "topic"}}}); err != nil {
+		t.Errorf("re-declaring with the same type: %v", err)
+	}
+	if err := table.declare(config.Topology{Exchanges: []config.Exchange{{Name: "events", Type: "direct"}}}); !errors.Is(err, ErrExchangeTypeChanged) {
+		t.Errorf("changing the type: got %v, want ErrExchangeTypeChanged", err)
+	}
+	if err := table.declare(config.Topology{Exchanges: []config.Exchange{{Name: "h", Type: "headers"}}}); err == nil {
+		t.Error("declaring a headers exchange succeeded")
+	}
+	if err := table.declare(config.Topology{Bindings: []config.Binding{{Exchange: "missing", Queue: "q"}}}); !errors.Is(err, ErrUnknownExchange) {
+		t.Errorf("binding to an undeclared exchange: got %v, want ErrUnknownExchange", err)
+	}
+
+	if err := table.checkExchange(""); err != nil {
+		t.Errorf("default exchange: %v", err)
+	}
+	if err := table.checkExchange("missing"); !errors.Is(err, ErrUnknownExchange) {
+		t.Errorf("checkExchange(missing) = %v, want ErrUnknownExchange", err)
+	}
+}
+
+func TestConsumerRouterRoutes(t *testing.T) {
+	table := newRoutingTable()
+	err := table.declare(config.Topology{
+		Exchanges: []config.Exchange{
+			{Name: testExchange, Type: "fanout"},
+			{Name: "events", Type: "topic"},
+			{Name: "jobs", Type: "direct"},
+		},
+		Bindings: []config.Binding{{Exchange: "events", Queue: "audit", RoutingKeys: []string{"orders.#"}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	named := table.router("audit", true, []Binding{{Exchange: "jobs", RoutingKey: "resize"}})
+	tests := []struct {
+		exchange, key string
+		want          bool
+	}{
+		{"events", "orders.eu.created", true},
+		{"events", "users.created", false},
+		{"jobs", "resize", true},
+		{"jobs", "crop", false},
+		{"", "audit", true},
+		{"", "other", false},
+		{testExchange, "", false},
+	}
+	for _, tt := range tests {
+		if got := named.routes(tt.exchange, tt.key); got != tt.want {
+			t.Errorf("named queue: routes(%q, %q) = %t, want %t", tt.exchange, tt.key, got, tt.want)
+		}
+	}
+	if got, want := named.exchangeNames(), []string{"jobs", "events"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("exchangeNames() = %v, want %v", got, want)
+	}
+
+	// A generated queue without bindings follows the configured exchange
+	generated := table.router("amq.gen-1", false, nil)
+	if !generated.routes(testExchange, "anything") {
+		t.Error("generated queue does not receive from the configured exchange")
+	}
+	if generated.routes("", "amq.gen-1") {
+		t.Error("generated queue receives from the default exchange")
+	}
+	if got, want := generated.exchangeNames(), []string{testExchange}; !reflect.DeepEqual(got, want) {
+		t.Errorf("exchangeNames() = %v, want %v", got, want)
+	}
+}
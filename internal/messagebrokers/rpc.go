@@ -0,0 +1,235 @@
+package messagebrokers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/Roh-Bot/rabbitmq-pub-sub/internal/config"
+	"github.com/Roh-Bot/rabbitmq-pub-sub/pkg/loggers"
+	"github.com/rabbitmq/amqp091-go"
+	"sync"
+	"time"
+)
+
+const (
+	// directReplyTo is RabbitMQ's pseudo-queue for replies without a reply queue.
+	directReplyTo = "amq.rabbitmq.reply-to"
+	// HeaderRPCError carries the error returned by an RPC handler.
+	HeaderRPCError = "x-rpc-error"
+
+	defaultRPCTimeout = 10 * time.Second
+)
+
+var ErrRPCTimeout = errors.New("RabbitMQ RPC call timed out")
+
+// RPCError is returned by Call when the remote handler failed.
+type RPCError struct {
+	Message string
+}
+
+func (e *RPCError) Error() string {
+	return "RabbitMQ RPC handler failed: " + e.Message
+}
+
+// RPCHandler answers a request. The returned value is encoded and published
+// to the request's ReplyTo address; a non-nil error is sent back as an RPCError.
+type RPCHandler func(ctx context.Context, deliver amqp091.Delivery) (any, error)
+
+// RPCClient performs request/reply calls over direct reply-to. Concurrent
+// calls share one channel and are matched to replies by correlation id.
+type RPCClient struct {
+	r       *RabbitMq
+	ch      *amqp091.Channel
+	pending map[string]*pendingCall
+	mutex   *sync.Mutex
+}
+
+type pendingCall struct {
+	ch    *amqp091.Channel
+	reply chan amqp091.Delivery
+}
+
+func (r *RabbitMq) NewRPCClient() *RPCClient {
+	return &RPCClient{
+		r:       r,
+		pending: make(map[string]*pendingCall),
+		mutex:   new(sync.Mutex),
+	}
+}
+
+// channel returns the reply channel, opening it and starting the reply
+// consumer if there is none or the previous one was closed.
+func (c *RPCClient) channel() (*amqp091.Channel, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.ch != nil && !c.ch.IsClosed() {
+		return c.ch, nil
+	}
+
+	conn, err := c.r.connection()
+	if err != nil {
+		return nil, err
+	}
+	ch, err := conn.Channel()
+	if err != nil {
+		return nil, err
+	}
+	// Direct reply-to requires auto-ack
+	replies, err := ch.Consume(directReplyTo, "", true, false, false, false, nil)
+	if err != nil {
+		_ = ch.Close()
+		return nil, err
+	}
+
+	c.ch = ch
+	go c.dispatch(ch, replies)
+	return ch, nil
+}
+
+// dispatch hands every reply to the call waiting for its correlation id and
+// fails the calls made on ch once it is closed.
+func (c *RPCClient) dispatch(ch *amqp091.Channel, replies <-chan amqp091.Delivery) {
+	for d := range replies {
+		c.mutex.Lock()
+		call, ok := c.pending[d.CorrelationId]
+		delete(c.pending, d.CorrelationId)
+		c.mutex.Unlock()
+		if !ok {
+			loggers.Zap.Warnf("RabbitMQ RPC reply for unknown correlation id %s", d.CorrelationId)
+			continue
+		}
+		call.reply <- d
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for id, call := range c.pending {
+		if call.ch == ch {
+			close(call.reply)
+			delete(c.pending, id)
+		}
+	}
+}
+
+// Call publishes req to routingKey on the default exchange, unless
+// WithExchange is given, and waits for the reply. Without a deadline on ctx
+// the call times out after rabbitmq.rpc_timeout seconds.
+func (c *RPCClient) Call(ctx context.Context, routingKey string, req any, opts ...PublishOption) (amqp091.Delivery, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		timeout := time.Duration(config.GetConfig().RabbitMQ.RPCTimeout) * time.Second
+		if timeout <= 0 {
+			timeout = defaultRPCTimeout
+		}
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	ch, err := c.channel()
+	if err != nil {
+		return amqp091.Delivery{}, err
+	}
+
+	id := NewMessageId()
+	o, msg, err := preparePublishing(ctx, req, append(
+		[]PublishOption{WithExchange(""), WithRoutingKey(routingKey)},
+		append(opts, WithCorrelationId(id))...,
+	))
+	if err != nil {
+		return amqp091.Delivery{}, err
+	}
+	msg.ReplyTo = directReplyTo
+
+	reply := make(chan amqp091.Delivery, 1)
+	c.mutex.Lock()
+	c.pending[id] = &pendingCall{ch: ch, reply: reply}
+	c.mutex.Unlock()
+	defer func() {
+		c.mutex.Lock()
+		delete(c.pending, id)
+		c.mutex.Unlock()
+	}()
+
+	if err := ch.PublishWithContext(ctx, o.exchange, o.routingKey, false, false, msg); err != nil {
+		return amqp091.Delivery{}, err
+	}
+
+	select {
+	case <-ctx.Done():
+		return amqp091.Delivery{}, fmt.Errorf("%w: %w", ErrRPCTimeout, ctx.Err())
+	case d, ok := <-reply:
+		if !ok {
+			return amqp091.Delivery{}, ErrConnectionClosed
+		}
+		if reason, ok := d.Headers[HeaderRPCError].(string); ok {
+			return d, &RPCError{Message: reason}
+		}
+		body, err := decompress(d.ContentEncoding, d.Body)
+		if err != nil {
+			return d, err
+		}
+		d.Body, d.ContentEncoding = body, ""
+		return d, nil
+	}
+}
+
+// Close closes the reply channel; pending calls fail with ErrConnectionClosed.
+func (c *RPCClient) Close() error {
+	c.mutex.Lock()
+	ch := c.ch
+	c.ch = nil
+	c.mutex.Unlock()
+	if ch == nil || ch.IsClosed() {
+		return nil
+	}
+	return ch.Close()
+}
+
+// Call is the typed variant of RPCClient.Call, decoding the reply into Resp.
+func Call[Req, Resp any](ctx context.Context, c *RPCClient, routingKey string, req Req, opts ...PublishOption) (Resp, error) {
+	var resp Resp
+	d, err := c.Call(ctx, routingKey, req, opts...)
+	if err != nil {
+		return resp, err
+	}
+	codec, err := CodecFor(d.ContentType)
+	if err != nil {
+		return resp, err
+	}
+	if err := codec.Unmarshal(d.Body, &resp); err != nil {
+		return resp, &DecodeError{MessageId: d.MessageId, Err: err}
+	}
+	return resp, nil
+}
+
+// ServeRPC consumes requests from the named queue and publishes each
+// handler's result to the request's ReplyTo address.
+func (r *RabbitMq) ServeRPC(wg *sync.WaitGroup, queue string, handler RPCHandler, opts ...ConsumerOption) {
+	r.Consume(wg, DeliveryHandler(func(ctx context.Context, deliver amqp091.Delivery) Acknowledgement {
+		resp, err := handler(ctx, deliver)
+		if deliver.ReplyTo == "" {
+			loggers.Zap.Warnf("RabbitMQ RPC request %s has no reply address", deliver.MessageId)
+			return Ack
+		}
+
+		correlationId := deliver.CorrelationId
+		if correlationId == "" {
+			correlationId = deliver.MessageId
+		}
+		replyOpts := []PublishOption{
+			WithExchange(""),
+			WithRoutingKey(deliver.ReplyTo),
+			WithCorrelationId(correlationId),
+		}
+		if err != nil {
+			replyOpts = append(replyOpts, WithHeader(HeaderRPCError, err.Error()))
+			resp = nil
+		}
+
+		if err := r.publish(ctx, resp, replyOpts); err != nil {
+			loggers.Zap.Errorf("RabbitMQ RPC reply to %s failed: %s", deliver.ReplyTo, err.Error())
+			return Drop
+		}
+		return Ack
+	}), append([]ConsumerOption{WithQueue(queue)}, opts...)...)
+}
@@ -0,0 +1,128 @@
+package messagebrokers
+
+import (
+	"context"
+	"fmt"
+	"github.com/rabbitmq/amqp091-go"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// redeliveryDelay spaces out redeliveries of requeued messages.
+const redeliveryDelay = time.Second
+
+// settlement is how the handler settled the pending delivery.
+type settlement struct {
+	tag     uint64
+	requeue bool
+	delay   time.Duration
+	headers amqp091.Table
+}
+
+// serialAcknowledger hands a consumer one delivery at a time and waits until
+// it is settled, for backends that track progress as an offset rather than
+// per message. It is the Acknowledger of the deliveries it hands out.
+type serialAcknowledger struct {
+	queue   string
+	tag     string
+	autoAck bool
+
+	pending atomic.Uint64
+	settled chan settlement
+}
+
+func newSerialAcknowledger(queue, tag string, autoAck bool) *serialAcknowledger {
+	return &serialAcknowledger{
+		queue:   queue,
+		tag:     tag,
+		autoAck: autoAck,
+		settled: make(chan settlement, 1),
+	}
+}
+
+// deliver sends d to msgs, redelivering it after a delay until it is acked
+// or rejected. d.DeliveryTag must not be zero.
+func (a *serialAcknowledger) deliver(ctx context.Context, msgs chan<- amqp091.Delivery, d amqp091.Delivery) error {
+	d.ConsumerTag = a.tag
+	d.Acknowledger = a
+	for {
+		a.pending.Store(d.DeliveryTag)
+		select {
+		case msgs <- d:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if a.autoAck {
+			return nil
+		}
+
+		// A settlement of an earlier delivery whose wait was cancelled may
+		// still be buffered, and is ignored
+		var s settlement
+		for s.tag != d.DeliveryTag {
+			select {
+			case s = <-a.settled:
+			case <-ctx.Done():
+				a.pending.CompareAndSwap(d.DeliveryTag, 0)
+				return ctx.Err()
+			}
+		}
+		if !s.requeue {
+			return nil
+		}
+
+		select {
+		case <-time.After(max(s.delay, redeliveryDelay)):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		d.Redelivered = true
+		if s.headers != nil {
+			d.Headers = s.headers
+		}
+	}
+}
+
+func (a *serialAcknowledger) settle(s settlement) error {
+	if !a.pending.CompareAndSwap(s.tag, 0) {
+		return fmt.Errorf("%w: %d", ErrUnknownDeliveryTag, s.tag)
+	}
+	a.settled <- s
+	return nil
+}
+
+func (a *serialAcknowledger) Ack(tag uint64, _ bool) error {
+	return a.settle(settlement{tag: tag})
+}
+
+// Nack without requeue discards the message; there is no dead-letter queue.
+func (a *serialAcknowledger) Nack(tag uint64, _ bool, requeue bool) error {
+	if !requeue {
+		log.Printf("Dropped message %d on queue %s", tag, a.queue)
+	}
+	return a.settle(settlement{tag: tag, requeue: requeue})
+}
+
+func (a *serialAcknowledger) Reject(tag uint64, requeue bool) error {
+	return a.Nack(tag, false, requeue)
+}
+
+// retry redelivers the message after the retry tier's delay, recording the
+// attempt in x-death. Exhausted messages are dropped.
+func (a *serialAcknowledger) retry(_ context.Context, queueName string, deliver amqp091.Delivery) error {
+	if !retryEnabled() {
+		return deliver.Nack(false, true)
+	}
+
+	tier, ok := nextRetryTier(deliver)
+	if !ok {
+		return deliver.Reject(false)
+	}
+	return a.settle(settlement{
+		tag:     deliver.DeliveryTag,
+		requeue: true,
+		delay:   tier,
+		headers: recordDeath(deliver.Headers, retryTierName(tier), queueName),
+	})
+}
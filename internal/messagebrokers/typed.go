@@ -0,0 +1,79 @@
+package messagebrokers
+
+import (
+	"context"
+	"fmt"
+	"github.com/rabbitmq/amqp091-go"
+	"sync"
+)
+
+// TypedHandler processes a delivery whose body has been decoded into T.
+type TypedHandler[T any] func(ctx context.Context, msg Envelope[T]) Acknowledgement
+
+// DecodeError reports a delivery whose body could not be decoded.
+type DecodeError struct {
+	MessageId string
+	Err       error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("decoding message %q: %s", e.MessageId, e.Err)
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// Publish encodes msg and publishes it through b. See RabbitMq.Publish.
+func Publish[T any](ctx context.Context, b MessageBroker, msg T, opts ...PublishOption) error {
+	return b.Publish(ctx, msg, opts...)
+}
+
+// PublishEnvelope publishes env.Body with the properties and headers set on
+// env. Options given explicitly take precedence over the envelope.
+func PublishEnvelope[T any](ctx context.Context, b MessageBroker, env Envelope[T], opts ...PublishOption) error {
+	envOpts := []PublishOption{
+		WithMessageId(env.MessageId),
+		WithCorrelationId(env.CorrelationId),
+		WithMessageType(env.Type),
+	}
+	for k, v := range env.Headers {
+		envOpts = append(envOpts, WithHeader(k, v))
+	}
+	return b.Publish(ctx, env.Body, append(envOpts, opts...)...)
+}
+
+// Subscribe consumes messages decoded into T by the codec matching each
+// delivery's content type. Deliveries that fail to decode, including those
+// with an unknown content type, are reported to the consumer's ErrorHandler
+// and dropped without stopping the consumer.
+func Subscribe[T any](wg *sync.WaitGroup, b MessageBroker, handler TypedHandler[T], opts ...ConsumerOption) {
+	o := newConsumerOptions(opts)
+	b.Consume(wg, Decode(handler, o.errorHandler), opts...)
+}
+
+// Decode adapts a TypedHandler into a DeliveryHandler.
+func Decode[T any](handler TypedHandler[T], onError ErrorHandler) DeliveryHandler {
+	return func(ctx context.Context, deliver amqp091.Delivery) Acknowledgement {
+		codec, err := CodecFor(deliver.ContentType)
+		if err != nil {
+			onError(ctx, deliver, &DecodeError{MessageId: deliver.MessageId, Err: err})
+			return Drop
+		}
+
+		var msg T
+		if err := codec.Unmarshal(deliver.Body, &msg); err != nil {
+			onError(ctx, deliver, &DecodeError{MessageId: deliver.MessageId, Err: err})
+			return Drop
+		}
+		return handler(ctx, newEnvelope(msg, deliver))
+	}
+}
+
+// FanOut returns a handler forwarding every message to the subscribers of p.
+func FanOut[T any](p *Publisher[T]) TypedHandler[T] {
+	return func(_ context.Context, msg Envelope[T]) Acknowledgement {
+		p.publishMessage(msg.Delivery.RoutingKey, msg.Body)
+		return Ack
+	}
+}